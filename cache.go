@@ -0,0 +1,324 @@
+package retag
+
+import (
+	"container/list"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// typeCache is the cache of generated types. It is an LRU cache if the capacity is set.
+// Entries are looked up in a read-only map which is replaced atomically, so the hit path
+// is lock-free unless the capacity is set. Writes are serialized by the mutex and go to the map
+// of all entries. It is copied to a new read-only map once the lookups which missed
+// the read-only map pay for the copy, as sync.Map promotes its dirty map.
+// The maps are typed rather than sync.Map: hashing of a key boxed into an interface costs
+// as much as the rest of a cached conversion. The entries are also linked into the list
+// from the most to the least recently used one, a hit moves its entry to the front under
+// the mutex if the capacity is set, and eviction drops entries from the back.
+type typeCache struct {
+	// the counters are accessed atomically, they are the first fields to be 64-bit aligned
+	hits     int64
+	misses   int64
+	capacity int64
+
+	read atomic.Value // map[cacheKey]*cacheEntry, read-only
+
+	mu sync.Mutex
+	// m holds all entries, lru links them by recency, readMisses is the number of lookups
+	// which missed the read-only map since it was copied, all are guarded by mu
+	m          map[cacheKey]*cacheEntry
+	lru        list.List // of *cacheEntry
+	readMisses int
+}
+
+type cacheEntry struct {
+	// dropped is set atomically when the entry is dropped from m,
+	// the entry stays in the read-only map until it is copied again.
+	dropped int32
+	key     cacheKey
+	elem    *list.Element // guarded by typeCache.mu, nil once dropped
+	res     result
+}
+
+var cache = typeCache{m: make(map[cacheKey]*cacheEntry)}
+
+func (c *typeCache) load(key cacheKey) (result, bool) {
+	res, ok := c.loadHit(key)
+	if !ok {
+		atomic.AddInt64(&c.misses, 1)
+	}
+	return res, ok
+}
+
+// loadHit is load which counts hits only, a miss is counted by the following load.
+func (c *typeCache) loadHit(key cacheKey) (result, bool) {
+	read, _ := c.read.Load().(map[cacheKey]*cacheEntry)
+	e, ok := read[key]
+	if !ok || atomic.LoadInt32(&e.dropped) != 0 {
+		if e, ok = c.loadLocked(key); !ok {
+			return result{}, false
+		}
+	}
+	atomic.AddInt64(&c.hits, 1)
+	if atomic.LoadInt64(&c.capacity) > 0 {
+		c.touch(e)
+	}
+	return e.res, true
+}
+
+// touch moves the entry to the front of the recency list unless it has been dropped.
+func (c *typeCache) touch(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e.elem != nil {
+		c.lru.MoveToFront(e.elem)
+	}
+}
+
+// loadLocked looks the key up in the map of all entries.
+func (c *typeCache) loadLocked(key cacheKey) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[key]
+	if c.readMisses++; c.readMisses >= len(c.m) {
+		c.copyRead()
+	}
+	return e, ok
+}
+
+// copyRead replaces the read-only map by a copy of all entries, c.mu must be locked.
+func (c *typeCache) copyRead() {
+	read := make(map[cacheKey]*cacheEntry, len(c.m))
+	for key, e := range c.m {
+		read[key] = e
+	}
+	c.read.Store(read)
+	c.readMisses = 0
+}
+
+// store puts the result into the cache unless the key is already there
+// and returns the stored result.
+func (c *typeCache) store(key cacheKey, res result) result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.m[key]; ok {
+		return e.res
+	}
+	e := &cacheEntry{key: key, res: res}
+	e.elem = c.lru.PushFront(e)
+	c.m[key] = e
+	c.evict()
+	return res
+}
+
+// evict drops the least recently used entries above the capacity, c.mu must be locked.
+func (c *typeCache) evict() {
+	capacity := int(atomic.LoadInt64(&c.capacity))
+	for capacity > 0 && len(c.m) > capacity {
+		c.drop(c.lru.Back().Value.(*cacheEntry).key)
+	}
+}
+
+// drop drops the entry from m and the recency list, c.mu must be locked.
+func (c *typeCache) drop(key cacheKey) {
+	e := c.m[key]
+	atomic.StoreInt32(&e.dropped, 1)
+	c.lru.Remove(e.elem)
+	e.elem = nil
+	delete(c.m, key)
+}
+
+// clear drops all entries.
+func (c *typeCache) clear() {
+	c.clearIf(func(cacheKey) bool { return true })
+}
+
+// clearIf drops the entries which keys match. The read-only map is copied at once,
+// so the dropped types can be collected.
+func (c *typeCache) clearIf(match func(cacheKey) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.m {
+		if match(key) {
+			c.drop(key)
+		}
+	}
+	c.copyRead()
+}
+
+func (c *typeCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.m)
+}
+
+// CacheStatsInfo describes the usage of the cache of generated types.
+type CacheStatsInfo struct {
+	// Hits is the number of types found in the cache.
+	Hits int64
+	// Misses is the number of types which had to be generated.
+	// Many misses and a growing number of entries usually mean that a new maker is created
+	// for every call instead of reusing the same one.
+	Misses int64
+	// Entries is the number of entries of the cache.
+	Entries int
+}
+
+// CacheStats returns the statistics of the cache of generated types collected since the start
+// of the process or the last call of ResetCacheStats. Conversions with Options.NoCache are not counted.
+func CacheStats() CacheStatsInfo {
+	return CacheStatsInfo{
+		Hits:    atomic.LoadInt64(&cache.hits),
+		Misses:  atomic.LoadInt64(&cache.misses),
+		Entries: CacheLen(),
+	}
+}
+
+// ResetCacheStats zeroes the counters of hits and misses of the cache of generated types.
+func ResetCacheStats() {
+	atomic.StoreInt64(&cache.hits, 0)
+	atomic.StoreInt64(&cache.misses, 0)
+}
+
+// SetCacheCapacity limits the number of entries of the cache of generated types:
+// the least recently used entries are dropped when the limit is exceeded. Zero means
+// no limit, it is the default. If the cache holds more entries, the excess is dropped immediately.
+// With a limit every hit updates the recency of its entry under a lock,
+// so concurrent cached conversions contend on it.
+// A dropped type is generated again on the next use; values converted before are still valid.
+// The limit doesn't bound the interned values the entries refer to, see ClearCache.
+func SetCacheCapacity(n int) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	atomic.StoreInt64(&cache.capacity, int64(n))
+	cache.evict()
+}
+
+// A CacheKey describes an entry of the cache of generated types:
+// the source type and the maker used to generate its analogue.
+type CacheKey struct {
+	Type reflect.Type
+	// Maker is nil for IdentifiedTagMaker, such makers are identified by their identities.
+	Maker TagMaker
+}
+
+// CacheKeys returns a snapshot of keys of the cache of generated types in no particular order.
+// It is intended for debugging purposes, e.g. to investigate growth of memory
+// or to verify that the expected types are cached.
+func CacheKeys() []CacheKey {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	var keys []CacheKey
+	for key := range cache.m {
+		keys = append(keys, CacheKey{key.Type, key.TagMaker})
+	}
+	return keys
+}
+
+// CacheLen returns the number of entries of the cache of generated types.
+func CacheLen() int {
+	return cache.len()
+}
+
+// ClearCache drops all entries of the cache of generated types. The cache grows for every
+// distinct pair of a type and a maker, so a process which creates many short-lived makers
+// can bound the memory by clearing the cache from time to time. It is safe to call ClearCache
+// concurrently with conversions, but the types have to be generated again. Values converted
+// before are still valid.
+//
+// The package interns the values which make keys of the cache comparable: the lists made by
+// WithOpaqueTypes and WithFields, the makers made by NewCompositeTagMaker, the identities of
+// IdentifiedTagMaker, the sets of options and the paths of PathAwareTagMaker. Neither clearing
+// nor eviction drops them, only Reset does, so they grow with every distinct value.
+// Make such values once and reuse them rather than building them for every call.
+func ClearCache() {
+	cache.clear()
+}
+
+// ClearCacheFor drops the entries of the cache of generated types made by the maker,
+// including the entries of types which use the maker as Options.ElemMaker, e.g. after
+// the behaviour of the maker has been changed. Converters returned by ConverterFor
+// for the maker are dropped too, so the next call of ConverterFor makes a new one.
+// Types generated by other makers stay cached.
+// The maker must be comparable (or IdentifiedTagMaker), otherwise ClearCacheFor panics with *Error.
+// See ClearCache for notes on concurrency.
+func ClearCacheFor(maker TagMaker) {
+	mk := checkMaker(maker)
+	match := func(key cacheKey) bool {
+		return key.makerKey() == mk || key.elemMaker() != nil && newMakerKey(key.elemMaker()) == mk
+	}
+	cache.clearIf(match)
+
+	converters.Lock()
+	defer converters.Unlock()
+	for key := range converters.m {
+		if match(key) {
+			delete(converters.m, key)
+		}
+	}
+}
+
+// Warmup generates and caches the analogues of types of the samples (pointers to structures,
+// slices, arrays or maps as for Convert; nil pointers are fine, only their types are used),
+// so the first conversions don't pay the cost of generation. It also validates the types:
+// Warmup returns an error of type *Error mentioning the index of the first sample which
+// can't be converted by the maker instead of deferring the failure to the first use.
+func Warmup(samples []interface{}, maker TagMaker) (err error) {
+	defer catch(&err)
+	for i, sample := range samples {
+		warmupType(i, reflect.TypeOf(sample), maker)
+	}
+	return nil
+}
+
+func warmupType(i int, t reflect.Type, maker TagMaker) {
+	defer prefixError("sample %d: ", i)
+	if t == nil || t.Kind() != reflect.Pointer {
+		panic(errorf(t, "unable to convert %v, a pointer is expected", t))
+	}
+	checkConvertible(t.Elem())
+	newConversion(maker, Options{}).getType(t.Elem())
+}
+
+// Reset returns the package to the pristine state: it drops cached types, the capacity
+// and the statistics of the cache, Converters returned by ConverterFor, and the types
+// registered by RegisterOpaqueType and RegisterTypeMapper (the default opaque types stay).
+// It is intended for isolation of tests and benchmarks.
+//
+// Reset must not be called concurrently with conversions.
+func Reset() {
+	ClearCache()
+	SetCacheCapacity(0)
+	ResetCacheStats()
+
+	opaqueTypes.Lock()
+	opaqueTypes.m = defaultOpaqueTypes()
+	opaqueTypes.Unlock()
+
+	typeMappers.Lock()
+	typeMappers.m = make(map[reflect.Type]reflect.Type)
+	typeMappers.Unlock()
+
+	converters.Lock()
+	converters.m = make(map[cacheKey]*Converter)
+	converters.Unlock()
+
+	pathNodes.Lock()
+	pathNodes.m = make(map[pathNodeKey]*pathNode)
+	pathNodes.Unlock()
+
+	opaqueLists.Lock()
+	opaqueLists.m = make(map[opaqueList]*opaqueList)
+	opaqueLists.Unlock()
+
+	fieldLists.Lock()
+	fieldLists.m = make(map[fieldList]*fieldList)
+	fieldLists.Unlock()
+
+	compositeMakers.Lock()
+	compositeMakers.m = make(map[compositeMaker]*compositeMaker)
+	compositeMakers.Unlock()
+
+	keyExts.reset()
+}
@@ -0,0 +1,310 @@
+package retag
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheKeys(test *testing.T) {
+	Convert(new(Struct), maker{})
+	Convert(new(FlatStruct), Snaker("json"))
+	keys := CacheKeys()
+	expected := []CacheKey{
+		{reflect.TypeOf(Struct{}), maker{}},
+		{reflect.TypeOf(FlatStruct{}), maker{}},
+		{reflect.TypeOf(FlatStruct{}), Snaker("json")},
+	}
+	for _, key := range expected {
+		if !containsCacheKey(keys, key) {
+			test.Errorf("Expect key %v in the snapshot %v", key, keys)
+		}
+	}
+	keys[0] = CacheKey{}
+	if containsCacheKey(CacheKeys(), CacheKey{}) {
+		test.Error("The snapshot should not share memory with the cache")
+	}
+}
+
+func containsCacheKey(keys []CacheKey, key CacheKey) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReset(test *testing.T) {
+	Convert(new(Struct), maker{})
+	Convert(new(pathOuter), sliceOmitter{})
+	c := MustConverterFor(reflect.TypeOf(FlatStruct{}), maker{})
+	RegisterOpaqueType(reflect.TypeOf(opaqueStruct{}))
+	RegisterTypeMapper(reflect.TypeOf(secretBox{}), reflect.TypeOf(secretBoxMirror{}))
+	Reset()
+	if isOpaque(reflect.TypeOf(opaqueStruct{})) || mappedType(reflect.TypeOf(secretBox{})) != nil {
+		test.Error("Expect registered types to be dropped")
+	}
+	if !isOpaque(reflect.TypeOf(time.Time{})) {
+		test.Error("Expect default opaque types to stay")
+	}
+	if keys := CacheKeys(); len(keys) != 0 {
+		test.Errorf("Expect empty cache but got %v", keys)
+	}
+	if MustConverterFor(reflect.TypeOf(FlatStruct{}), maker{}) == c {
+		test.Error("Expect a new Converter after Reset")
+	}
+	(&MapTestCase{Result: `{"Xport1":0,"Xport2":{"Xport":0}}`}).checkResult(Convert(new(Struct), maker{}), test)
+}
+
+func TestConcurrentConvert(test *testing.T) {
+	type Concurrent struct {
+		Name  string
+		Inner []FlatStruct
+	}
+	const n = 100
+	types := make(chan reflect.Type, n)
+	var start sync.WaitGroup
+	start.Add(1)
+	for i := 0; i < n; i++ {
+		go func() {
+			start.Wait()
+			types <- reflect.TypeOf(Convert(new(Concurrent), Snaker("concurrent")))
+		}()
+	}
+	start.Done()
+	first := <-types
+	for i := 1; i < n; i++ {
+		if t := <-types; t != first {
+			test.Fatalf("Expect the same type but got %s and %s", first, t)
+		}
+	}
+}
+
+func TestClearCache(test *testing.T) {
+	before := CacheLen()
+	for i := 0; i < 10; i++ {
+		Convert(new(FlatStruct), Snaker(fmt.Sprintf("key%d", i)))
+	}
+	if n := CacheLen(); n < before+10 {
+		test.Errorf("Expect at least %d entries but got %d", before+10, n)
+	}
+	ClearCache()
+	if n := CacheLen(); n != 0 {
+		test.Errorf("Expect empty cache but got %d entries", n)
+	}
+	(&MapTestCase{Result: `{"Xport":0}`}).checkResult(Convert(new(FlatStruct), maker{}), test)
+	if n := CacheLen(); n == 0 {
+		test.Error("Expect the cache to be populated again")
+	}
+}
+
+func TestClearCacheFor(test *testing.T) {
+	ClearCache()
+	ResetCacheStats()
+	type clearedStruct struct{ Omit, Xport int }
+	cleared, kept := Snaker("clear_cache_for"), Snaker("clear_cache_for_kept")
+	Convert(new(clearedStruct), cleared)
+	Convert(new(clearedStruct), kept)
+	if _, err := (Options{ElemMaker: cleared}).Convert(new([]clearedStruct), maker{}); err != nil {
+		test.Fatal(err)
+	}
+	converter := MustConverterFor(reflect.TypeOf(clearedStruct{}), cleared)
+	ClearCacheFor(cleared)
+	for _, key := range CacheKeys() {
+		if key.Maker == cleared || key.Maker == (maker{}) && key.Type == reflect.TypeOf([]clearedStruct{}) {
+			test.Errorf("Expect no entries of the cleared maker but got %v", key)
+		}
+	}
+	if !containsCacheKey(CacheKeys(), CacheKey{reflect.TypeOf(clearedStruct{}), kept}) {
+		test.Error("Expect the entries of another maker to survive")
+	}
+	if MustConverterFor(reflect.TypeOf(clearedStruct{}), cleared) == converter {
+		test.Error("Expect the Converter of the cleared maker to be made again")
+	}
+	ResetCacheStats()
+	Convert(new(clearedStruct), kept)
+	if s := CacheStats(); s.Misses != 0 || s.Hits != 1 {
+		test.Errorf("Expect a cache hit for another maker but got %+v", s)
+	}
+
+	test.Run("NotComparable", func(test *testing.T) {
+		defer shouldPanic(test)
+		ClearCacheFor(sliceMaker{})
+	})
+}
+
+func TestCacheCapacity(test *testing.T) {
+	type A struct{ Xa int }
+	type B struct{ Xb int }
+	type C struct{ Xc int }
+	ClearCache()
+	SetCacheCapacity(3)
+	defer SetCacheCapacity(0)
+	m := Snaker("lru")
+	Convert(new(A), m)
+	Convert(new(B), m)
+	Convert(new(A), m)
+	Convert(new(C), m)
+	keys := CacheKeys()
+	if len(keys) != 3 {
+		test.Errorf("Expect 3 entries but got %v", keys)
+	}
+	for _, t := range []reflect.Type{reflect.TypeOf(0), reflect.TypeOf(A{}), reflect.TypeOf(C{})} {
+		if !containsCacheKey(keys, CacheKey{t, m}) {
+			test.Errorf("Expect %s in the cache %v", t, keys)
+		}
+	}
+	if containsCacheKey(keys, CacheKey{reflect.TypeOf(B{}), m}) {
+		test.Errorf("Expect the least recently used B to be evicted from %v", keys)
+	}
+	(&MapTestCase{Result: `{"Xb":1}`}).checkResult(Convert(&B{1}, m), test)
+	if tag := reflect.TypeOf(Convert(new(B), m)).Elem().Field(0).Tag; tag != `lru:"xb"` {
+		test.Errorf("Unexpected tag `%s` of the recomputed type", tag)
+	}
+}
+
+func TestCacheStats(test *testing.T) {
+	type stats struct{ Xport int }
+	ResetCacheStats()
+	m := Snaker("stats")
+	Convert(new(stats), m)
+	Convert(new(stats), m)
+	s := CacheStats()
+	// the structure and its int field are missed once, the structure is hit once
+	if s.Misses != 2 || s.Hits != 1 || s.Entries != CacheLen() {
+		test.Errorf("Unexpected statistics %+v", s)
+	}
+	ResetCacheStats()
+	if s := CacheStats(); s.Hits != 0 || s.Misses != 0 {
+		test.Errorf("Expect zero counters but got %+v", s)
+	}
+}
+
+func TestWarmup(test *testing.T) {
+	type warm struct{ Xport int }
+	type unsupported struct{ Xfn func() }
+	m := Snaker("warm")
+	if err := Warmup([]interface{}{(*warm)(nil), new([]FlatStruct)}, m); err != nil {
+		test.Fatal(err)
+	}
+	ResetCacheStats()
+	Convert(new(warm), m)
+	if s := CacheStats(); s.Misses != 0 || s.Hits != 1 {
+		test.Errorf("Expect a cache hit after the warmup but got %+v", s)
+	}
+
+	err := Warmup([]interface{}{new(warm), new(unsupported)}, m)
+	if e, ok := err.(*Error); !ok || !strings.HasPrefix(e.Msg, "sample 1: ") {
+		test.Errorf("Expect *Error about the sample 1 but got %v", err)
+	}
+	err = Warmup([]interface{}{nil}, m)
+	if e, ok := err.(*Error); !ok || e.Msg != "sample 0: unable to convert <nil>, a pointer is expected" {
+		test.Errorf("Expect *Error about the nil sample but got %v", err)
+	}
+}
+
+// configMaker is built per call from a configuration, the map makes it not comparable.
+type configMaker struct {
+	name string
+	tags map[string]reflect.StructTag
+}
+
+func (m *configMaker) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	return m.tags[t.Field(fieldIndex).Name]
+}
+
+func (m *configMaker) Identity() interface{} {
+	return m.name
+}
+
+func TestIdentifiedTagMaker(test *testing.T) {
+	type identified struct{ Xport int }
+	config := func(name, tag string) TagMaker {
+		return &configMaker{name, map[string]reflect.StructTag{"Xport": reflect.StructTag(tag)}}
+	}
+	first := reflect.TypeOf(Convert(new(identified), config("a", `id:"a"`)))
+	ResetCacheStats()
+	second := reflect.TypeOf(Convert(new(identified), config("a", `id:"a"`)))
+	if first != second {
+		test.Errorf("Expect the same type for equal identities but got %s and %s", first, second)
+	}
+	if s := CacheStats(); s.Misses != 0 || s.Hits != 1 {
+		test.Errorf("Expect a cache hit for an equal identity but got %+v", s)
+	}
+	if tag := reflect.TypeOf(Convert(new(identified), config("b", `id:"b"`))).Elem().Field(0).Tag; tag != `id:"b"` {
+		test.Errorf("Expect the tag `id:\"b\"` for another identity but got `%s`", tag)
+	}
+	if !containsCacheKey(CacheKeys(), CacheKey{reflect.TypeOf(identified{}), nil}) {
+		test.Error("Expect a key without the maker for an identified maker")
+	}
+
+	test.Run("NotComparable", func(test *testing.T) {
+		defer shouldPanic(test)
+		Convert(new(identified), sliceIdentityMaker{})
+	})
+}
+
+type sliceIdentityMaker struct{}
+
+func (sliceIdentityMaker) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	return ""
+}
+
+func (sliceIdentityMaker) Identity() interface{} {
+	return []string{"a"}
+}
+
+func BenchmarkConcurrentConvert(b *testing.B) {
+	p := new(ComplexStruct)
+	opts := Options{MaxFields: 100}
+	for _, bench := range []struct {
+		name    string
+		convert func()
+	}{
+		{"Convert", func() { Convert(p, maker{}) }},
+		{"ConvertAny", func() { ConvertAny(p, maker{}) }},
+		{"Options", func() { opts.Convert(p, maker{}) }},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			bench.convert()
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					bench.convert()
+				}
+			})
+		})
+	}
+}
+
+type benchMaker int
+
+func (benchMaker) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	return ""
+}
+
+func BenchmarkCacheEvict(b *testing.B) {
+	for _, capacity := range []int{16, 1024, 65536} {
+		b.Run(strconv.Itoa(capacity), func(b *testing.B) {
+			ClearCache()
+			SetCacheCapacity(capacity)
+			defer SetCacheCapacity(0)
+			defer ClearCache()
+			t := reflect.TypeOf(0)
+			// twice as many keys as the capacity, so every store evicts an entry
+			keys := make([]cacheKey, 2*capacity)
+			for i := range keys {
+				keys[i] = cacheKey{Type: t, TagMaker: benchMaker(i)}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cache.store(keys[i%len(keys)], result{})
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package retag
+
+import (
+	"context"
+)
+
+// ConvertContext converts p in the same way as ConvertE does, but aborts the conversion
+// and returns ctx.Err() if the context is done before the type is generated. The context is
+// checked for every type met during the conversion, so the generation of an enormous type
+// can be cancelled. Types completely generated before the cancellation stay in the cache,
+// the aborted ones are not stored.
+func ConvertContext(ctx context.Context, p interface{}, maker TagMaker) (res interface{}, err error) {
+	defer catch(&err)
+	defer func() {
+		if p := recover(); p != nil {
+			c, ok := p.(canceled)
+			if !ok {
+				panic(p)
+			}
+			res, err = nil, c.err
+		}
+	}()
+	return convert(p, maker, Options{ctx: ctx}), nil
+}
+
+// canceled is a panic value which aborts a conversion when the context is done.
+type canceled struct {
+	err error
+}
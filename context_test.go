@@ -0,0 +1,55 @@
+package retag
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// cancelingMaker cancels the context when it makes a tag of a field of the structure
+// type t, the pointer makes it comparable.
+type cancelingMaker struct {
+	t      reflect.Type
+	cancel context.CancelFunc
+}
+
+func (m *cancelingMaker) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	if t == m.t {
+		m.cancel()
+	}
+	return `json:"-"`
+}
+
+func TestConvertContext(test *testing.T) {
+	type inner struct{ Xport int }
+	type outer struct {
+		Xfirst  inner
+		Xsecond FlatStruct
+	}
+	res, err := ConvertContext(context.Background(), &FlatStruct{Xport: 1}, maker{})
+	if err != nil {
+		test.Fatal(err)
+	}
+	(&MapTestCase{Result: `{"Xport":1}`}).checkResult(res, test)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ConvertContext(ctx, new(outer), maker{}); err != context.Canceled {
+		test.Errorf("Expect context.Canceled but got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	m := &cancelingMaker{reflect.TypeOf(inner{}), cancel}
+	if _, err := ConvertContext(ctx, new(outer), m); err != context.Canceled {
+		test.Errorf("Expect context.Canceled in the middle of the conversion but got %v", err)
+	}
+	for _, key := range CacheKeys() {
+		if key.Maker == m && key.Type == reflect.TypeOf(outer{}) {
+			test.Error("Expect the aborted type not to be cached")
+		}
+	}
+
+	if _, err := ConvertContext(context.Background(), FlatStruct{}, maker{}); err == nil {
+		test.Error("Expect an error for a value which is not a pointer")
+	}
+}
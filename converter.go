@@ -0,0 +1,91 @@
+package retag
+
+import (
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// A Converter converts pointers to structures of one type using one maker.
+// The analogue type is generated once on creation of the Converter,
+// so a conversion is just a creation of a pointer. A Converter is safe for concurrent use.
+type Converter struct {
+	source reflect.Type
+	result reflect.Type
+}
+
+// Convert converts the pointer p in the same way as the Convert function does.
+// It panics with *Error if p has a type other than a pointer to the type of the Converter.
+func (c *Converter) Convert(p interface{}) interface{} {
+	v := reflect.ValueOf(p)
+	switch {
+	case !v.IsValid():
+		panic(errorf(nil, "unable to convert nil, a pointer is expected"))
+	case v.Kind() != reflect.Pointer:
+		panic(errorf(v.Type(), "unable to convert %s, because it is a %s, not a pointer", v.Type(), v.Kind()))
+	case v.Type() != c.source:
+		panic(errorf(v.Type(), "retag: Converter for %s is unable to convert %s", c.source, v.Type()))
+	}
+	return reflect.NewAt(c.result, unsafe.Pointer(v.Pointer())).Interface()
+}
+
+var converters = struct {
+	sync.Mutex
+	m map[cacheKey]*Converter
+}{
+	m: make(map[cacheKey]*Converter),
+}
+
+// ConverterFor returns a Converter of pointers to structures of the type t using the maker.
+// The Converter is created once for every pair of the type and the maker,
+// subsequent calls return the same Converter.
+// ConverterFor returns an error if t is not a structure or can't be converted.
+func ConverterFor(t reflect.Type, maker TagMaker) (c *Converter, err error) {
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, errorf(t, "retag: unable to make Converter for %v, because it is not a structure", t)
+	}
+	defer catch(&err)
+	key := newCacheKey(t, checkMaker(maker), &Options{}, nil)
+	converters.Lock()
+	c, ok := converters.m[key]
+	converters.Unlock()
+	if ok {
+		return c, nil
+	}
+	// the type is generated without the lock, so Converters of different types are made concurrently
+	res := newConversion(maker, Options{}).getType(t)
+	converters.Lock()
+	defer converters.Unlock()
+	if c, ok := converters.m[key]; ok {
+		return c, nil
+	}
+	c = &Converter{source: reflect.PointerTo(t), result: res.t}
+	converters.m[key] = c
+	return c, nil
+}
+
+// MustConverterFor is like ConverterFor but panics if the Converter can't be made.
+// It simplifies initialization of global variables holding Converters.
+func MustConverterFor(t reflect.Type, maker TagMaker) *Converter {
+	return must(ConverterFor(t, maker))
+}
+
+// NewConverter is like MustConverterFor but takes a sample pointer to structure instead of the type,
+// e.g. NewConverter(new(T), maker). Only the type of the sample is used.
+// It panics with *Error in the same cases as Convert.
+func NewConverter(samplePtr interface{}, maker TagMaker) *Converter {
+	t := reflect.TypeOf(samplePtr)
+	if t == nil || t.Kind() != reflect.Pointer {
+		panic(errorf(t, "retag: unable to make Converter for %v, because it is not a pointer", t))
+	}
+	return MustConverterFor(t.Elem(), maker)
+}
+
+// ConvertAndRegister converts p in the same way as Convert does and then calls register
+// with the source structure type and the generated one, e.g. to let a codec framework to wire up
+// hooks between the types. The register is not called if the conversion fails.
+func ConvertAndRegister(p interface{}, maker TagMaker, register func(src, dst reflect.Type)) interface{} {
+	res := Convert(p, maker)
+	register(reflect.TypeOf(p).Elem(), reflect.TypeOf(res).Elem())
+	return res
+}
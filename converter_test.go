@@ -0,0 +1,113 @@
+package retag
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestConverterFor(test *testing.T) {
+	t := reflect.TypeOf(FlatStruct{})
+	c, err := ConverterFor(t, maker{})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if again, _ := ConverterFor(t, maker{}); again != c {
+		test.Error("Expect the same Converter for the same type and maker")
+	}
+	if other, _ := ConverterFor(t, Snaker("json")); other == c {
+		test.Error("Expect different Converters for different makers")
+	}
+	(&MapTestCase{Result: `{"Xport":0}`}).checkResult(c.Convert(new(FlatStruct)), test)
+
+	for name, p := range map[string]interface{}{"OtherType": new(Struct), "Nil": nil, "NotPointer": FlatStruct{}} {
+		test.Run(name, func(test *testing.T) {
+			defer func() {
+				if _, ok := recover().(*Error); !ok {
+					test.Errorf("Expect a panic with *Error for %T", p)
+				}
+			}()
+			c.Convert(p)
+		})
+	}
+	test.Run("NotStruct", func(test *testing.T) {
+		if _, err := ConverterFor(reflect.TypeOf(0), maker{}); err == nil {
+			test.Error("Expect an error for a non-structure type")
+		}
+	})
+	test.Run("Nil", func(test *testing.T) {
+		if _, err := ConverterFor(nil, maker{}); err == nil {
+			test.Error("Expect an error for nil")
+		} else if _, ok := err.(*Error); !ok {
+			test.Errorf("Expect *Error but got %T", err)
+		}
+	})
+	test.Run("Unsupported", func(test *testing.T) {
+		if _, err := ConverterFor(reflect.TypeOf(struct{ I interface{} }{}), maker{}); err == nil {
+			test.Error("Expect an error for an unsupported type")
+		}
+	})
+	test.Run("Concurrent", func(test *testing.T) {
+		type concurrentStruct struct{ Xport int }
+		t := reflect.TypeOf(concurrentStruct{})
+		res := make([]*Converter, 8)
+		var wg sync.WaitGroup
+		for i := range res {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				res[i] = MustConverterFor(t, maker{})
+			}(i)
+		}
+		wg.Wait()
+		for _, c := range res {
+			if c != res[0] {
+				test.Fatal("Expect the same Converter for concurrent calls")
+			}
+		}
+	})
+}
+
+func TestMustConverterFor(test *testing.T) {
+	if c := MustConverterFor(reflect.TypeOf(FlatStruct{}), maker{}); c == nil {
+		test.Error("Expect Converter")
+	}
+	defer shouldPanic(test)
+	MustConverterFor(reflect.TypeOf(0), maker{})
+}
+
+func TestNewConverter(test *testing.T) {
+	c := NewConverter(new(FlatStruct), maker{})
+	if c != MustConverterFor(reflect.TypeOf(FlatStruct{}), maker{}) {
+		test.Error("Expect the same Converter as MustConverterFor returns")
+	}
+	(&MapTestCase{Result: `{"Xport":2}`}).checkResult(c.Convert(&FlatStruct{Omit: 1, Xport: 2}), test)
+	test.Run("OtherType", func(test *testing.T) {
+		defer shouldPanic(test)
+		c.Convert(new(Struct))
+	})
+	test.Run("NotPointer", func(test *testing.T) {
+		defer shouldPanic(test)
+		NewConverter(FlatStruct{}, maker{})
+	})
+}
+
+func TestConvertAndRegister(test *testing.T) {
+	var src, dst reflect.Type
+	register := func(s, d reflect.Type) {
+		src, dst = s, d
+	}
+	res := ConvertAndRegister(new(FlatStruct), maker{}, register)
+	if src != reflect.TypeOf(FlatStruct{}) || dst != reflect.TypeOf(res).Elem() || src == dst {
+		test.Errorf("Unexpected registered types %v and %v", src, dst)
+	}
+
+	src, dst = nil, nil
+	func() {
+		defer shouldPanic(test)
+		ConvertAndRegister(new(struct{ F func() }), maker{}, register)
+	}()
+	if src != nil || dst != nil {
+		test.Error("register should not be called for a failed conversion")
+	}
+}
@@ -0,0 +1,99 @@
+package retag
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// DeepConvert converts p in the same way as Convert does, but the result doesn't share memory
+// with p: a fresh value of the generated type is allocated and the data of the source is copied
+// into it, including the values referred by exported fields of pointer, slice, array and map types.
+// So the result can be modified independently and p doesn't have to outlive it.
+// Pointers which refer to the same value in the source refer to the same copy in the result,
+// so cyclic data is copied as well. Interfaces and unexported fields are copied shallowly.
+//
+// The values are copied, so the generated types don't have to keep the layout of the source ones:
+// DeepConvert adds marker fields of StructTagMaker, unlike other functions.
+//
+// Convert costs an allocation of the interface only, DeepConvert allocates and copies all
+// the data reachable from p, so it is as expensive as a deep copy of the source.
+//
+// DeepConvert panics in the same cases as Convert.
+func DeepConvert(p interface{}, maker TagMaker) interface{} {
+	v := reflect.ValueOf(p)
+	generated := convertElemType(v, maker, Options{structTags: true})
+	c := deepCopier{seen: make(map[deepCopyKey]reflect.Value)}
+	return c.copy(v, reflect.PointerTo(generated)).Interface()
+}
+
+type deepCopyKey struct {
+	p unsafe.Pointer
+	t reflect.Type
+}
+
+type deepCopier struct {
+	// seen maps source pointers to their copies.
+	seen map[deepCopyKey]reflect.Value
+}
+
+// copy copies v into a new value of the type t, t is v's type or its analogue.
+func (c *deepCopier) copy(v reflect.Value, t reflect.Type) reflect.Value {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return reflect.Zero(t)
+		}
+		key := deepCopyKey{unsafe.Pointer(v.Pointer()), t}
+		if res, ok := c.seen[key]; ok {
+			return res
+		}
+		res := reflect.New(t.Elem())
+		c.seen[key] = res
+		res.Elem().Set(c.copy(v.Elem(), t.Elem()))
+		return res
+	case reflect.Struct:
+		res := reflect.New(t).Elem()
+		if t == v.Type() {
+			res.Set(v)
+		} else if !v.CanAddr() {
+			// unexported fields are copied through their addresses
+			addressable := reflect.New(v.Type()).Elem()
+			addressable.Set(v)
+			v = addressable
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if f := res.Field(i); f.CanSet() {
+				f.Set(c.copy(v.Field(i), f.Type()))
+			} else if t != v.Type() {
+				src := reflect.NewAt(v.Field(i).Type(), unsafe.Pointer(v.Field(i).UnsafeAddr())).Elem()
+				reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem().Set(src)
+			}
+		}
+		return res
+	case reflect.Array:
+		res := reflect.New(t).Elem()
+		for i := 0; i < v.Len(); i++ {
+			res.Index(i).Set(c.copy(v.Index(i), t.Elem()))
+		}
+		return res
+	case reflect.Slice:
+		if v.IsNil() {
+			return reflect.Zero(t)
+		}
+		res := reflect.MakeSlice(t, v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			res.Index(i).Set(c.copy(v.Index(i), t.Elem()))
+		}
+		return res
+	case reflect.Map:
+		if v.IsNil() {
+			return reflect.Zero(t)
+		}
+		res := reflect.MakeMapWithSize(t, v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			res.SetMapIndex(c.copy(iter.Key(), t.Key()), c.copy(iter.Value(), t.Elem()))
+		}
+		return res
+	}
+	return v
+}
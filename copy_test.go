@@ -0,0 +1,85 @@
+package retag
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeepConvert(test *testing.T) {
+	p := &ComplexStruct{
+		XportStruct: Struct{Xport1: 1},
+		XportPtr:    &FlatStruct{Omit: 2, Xport: 3},
+		XportSlice:  []FlatStruct{{Xport: 4}},
+		XportMap:    map[string]*FlatStruct{"a": {Xport: 5}},
+	}
+	res := DeepConvert(p, maker{})
+	expected := `{"XportVoid":{},"XportStruct":{"Xport1":1,"Xport2":{"Xport":0}},"XportPtr":{"Xport":3},` +
+		`"XportSlice":[{"Xport":4}],"XportArray":[{"Xport":0},{"Xport":0}],"XportMap":{"a":{"Xport":5}}}`
+	(&MapTestCase{Result: expected}).checkResult(res, test)
+
+	p.XportPtr.Xport = 30
+	p.XportSlice[0].Xport = 40
+	p.XportMap["a"].Xport = 50
+	p.XportStruct.Xport1 = 10
+	(&MapTestCase{Result: expected}).checkResult(res, test)
+	if reflect.TypeOf(res) != reflect.TypeOf(Convert(p, maker{})) {
+		test.Errorf("Expect the type generated by Convert but got %s", reflect.TypeOf(res))
+	}
+}
+
+func TestDeepConvertCyclic(test *testing.T) {
+	list := &Node{Name: "a"}
+	list.Next = list
+	res := reflect.ValueOf(DeepConvert(list, Snaker("json")))
+	next := res.Elem().Field(1)
+	if next.Pointer() == reflect.ValueOf(list).Pointer() {
+		test.Error("Expect a copy of the cyclic value")
+	}
+	if next.Elem().Field(1).Pointer() != next.Pointer() {
+		test.Error("Expect the cycle to be kept in the copy")
+	}
+}
+
+// tableMaker annotates structures by the marker field Table with their names.
+type tableMaker struct {
+	name string
+}
+
+func (m tableMaker) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	return Snaker("json").MakeTag(t, fieldIndex)
+}
+
+func (m tableMaker) MakeStructTag(t reflect.Type) (string, reflect.StructTag, bool) {
+	if t.Name() == "" {
+		return "", "", false
+	}
+	return m.name, reflect.StructTag(`table:"` + t.Name() + `"`), true
+}
+
+func TestDeepConvertStructTags(test *testing.T) {
+	type row struct {
+		Xinner FlatStruct
+		Xafter int8
+		Xrows  []FlatStruct
+	}
+	p := &row{Xinner: FlatStruct{Omit: 1, Xport: 2}, Xafter: 3, Xrows: []FlatStruct{{Xport: 4}}}
+	res := DeepConvert(p, tableMaker{"Table"})
+	(&MapTestCase{Result: `{"xinner":{"omit":1,"xport":2,"Table":{}},"xafter":3,"xrows":[{"omit":0,"xport":4,"Table":{}}],"Table":{}}`}).checkResult(res, test)
+	field, ok := reflect.TypeOf(res).Elem().FieldByName("Table")
+	if !ok || field.Tag != `table:"row"` || field.Type.Size() != 0 {
+		test.Errorf("Expect the marker field with the tag `table:\"row\"` but got %+v", field)
+	}
+	// the aliasing conversion can't change the layout
+	if n := reflect.TypeOf(Convert(p, tableMaker{"Table"})).Elem().NumField(); n != 3 {
+		test.Errorf("Expect Convert to ignore the marker field but got %d fields", n)
+	}
+
+	test.Run("Unexported", func(test *testing.T) {
+		defer shouldPanic(test)
+		DeepConvert(p, tableMaker{"table"})
+	})
+	test.Run("Conflict", func(test *testing.T) {
+		defer shouldPanic(test)
+		DeepConvert(p, tableMaker{"Xafter"})
+	})
+}
@@ -0,0 +1,83 @@
+package retag
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// DescribeType returns a Go-like description of the type t which, unlike t.String(),
+// lists every field of structures on its own line with the full tag, e.g.
+//
+//	struct {
+//		Name string `json:"name"`
+//		Items []struct {
+//			ID int `json:"id"`
+//		} `json:"items"`
+//	}
+//
+// Unnamed types (generated types are always unnamed) are described recursively through
+// pointers, slices, arrays and maps. Named types of fields are described by their names,
+// it keeps the description of cyclic types finite; t itself (or its element if t is a pointer,
+// slice, array or map) is described by its structure even if it is named.
+// It is intended for debugging of makers.
+func DescribeType(t reflect.Type) string {
+	var b strings.Builder
+	describeType(&b, t, 0, true)
+	return b.String()
+}
+
+func describeType(b *strings.Builder, t reflect.Type, indent int, top bool) {
+	if t.Name() != "" && !top {
+		b.WriteString(t.String())
+		return
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if t.NumField() == 0 {
+			b.WriteString("struct {}")
+			return
+		}
+		b.WriteString("struct {\n")
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			b.WriteString(strings.Repeat("\t", indent+1))
+			if !field.Anonymous {
+				b.WriteString(field.Name)
+				b.WriteByte(' ')
+			}
+			describeType(b, field.Type, indent+1, false)
+			if field.Tag != "" {
+				b.WriteByte(' ')
+				b.WriteString(quoteTag(field.Tag))
+			}
+			b.WriteByte('\n')
+		}
+		b.WriteString(strings.Repeat("\t", indent))
+		b.WriteByte('}')
+	case reflect.Pointer:
+		b.WriteByte('*')
+		describeType(b, t.Elem(), indent, top)
+	case reflect.Slice:
+		b.WriteString("[]")
+		describeType(b, t.Elem(), indent, top)
+	case reflect.Array:
+		b.WriteString("[" + strconv.Itoa(t.Len()) + "]")
+		describeType(b, t.Elem(), indent, top)
+	case reflect.Map:
+		b.WriteString("map[")
+		describeType(b, t.Key(), indent, top)
+		b.WriteByte(']')
+		describeType(b, t.Elem(), indent, top)
+	default:
+		b.WriteString(t.String())
+	}
+}
+
+// quoteTag quotes the tag as a raw string literal if it is possible.
+func quoteTag(tag reflect.StructTag) string {
+	if strings.ContainsAny(string(tag), "`\n") {
+		return strconv.Quote(string(tag))
+	}
+	return "`" + string(tag) + "`"
+}
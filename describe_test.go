@@ -0,0 +1,40 @@
+package retag
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDescribeType(test *testing.T) {
+	type described struct {
+		Xname  string
+		Xitems []struct{ Xid int }
+		Xmap   map[string]*FlatStruct
+		Xnext  *Node
+		Xvoid  [2]struct{}
+	}
+	generated := reflect.TypeOf(Convert(new(described), Snaker("json"))).Elem()
+	expected := "struct {\n" +
+		"\tXname string `json:\"xname\"`\n" +
+		"\tXitems []struct {\n" +
+		"\t\tXid int `json:\"xid\"`\n" +
+		"\t} `json:\"xitems\"`\n" +
+		"\tXmap map[string]*struct {\n" +
+		"\t\tOmit int `json:\"omit\"`\n" +
+		"\t\tXport int `json:\"xport\"`\n" +
+		"\t} `json:\"xmap\"`\n" +
+		"\tXnext *struct {\n" +
+		"\t\tName string `json:\"name\"`\n" +
+		"\t\tNext *retag.Node `json:\"next\"`\n" +
+		"\t} `json:\"xnext\"`\n" +
+		"\tXvoid [2]struct {} `json:\"xvoid\"`\n" +
+		"}"
+	if got := DescribeType(generated); got != expected {
+		test.Errorf("Expect\n%s\nbut got\n%s", expected, got)
+	}
+	// a named type is described by its structure at the top level only
+	expected = "*struct {\n\tName string\n\tNext *retag.Node\n}"
+	if got := DescribeType(reflect.TypeOf(&Node{})); got != expected {
+		test.Errorf("Expect\n%s\nbut got\n%s", expected, got)
+	}
+}
@@ -0,0 +1,85 @@
+package retag
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// DynamicConvert converts p in the same way as ConvertAny does and additionally converts
+// values held by fields of empty interface type: a structure or a pointer to structure
+// stored in an interface{} field is replaced with its converted analogue. The dynamic
+// values are inspected at the time of the call, so the result depends on the value of p,
+// not only on its type.
+//
+// Replacing of interface values requires writing to memory, so the result doesn't share
+// memory with p: the value pointed by p is copied to a new location and the copy is modified.
+// Only the memory of the copy is walked, i.e. fields of nested structures and elements of arrays;
+// interfaces reached through pointers, slices and maps of the source are left unchanged
+// because they are shared with the source. Nil interfaces are left nil, interfaces with methods
+// are left unchanged because a generated type doesn't implement them.
+//
+// DynamicConvert panics in the same cases as ConvertAny.
+func DynamicConvert(p interface{}, maker TagMaker) interface{} {
+	d := dynamicConversion{maker: maker, seen: map[dynamicKey]reflect.Value{}}
+	return d.convertPointer(reflect.ValueOf(p)).Interface()
+}
+
+type dynamicConversion struct {
+	maker TagMaker
+	// seen maps source pointers to their converted copies,
+	// it keeps shared values shared and stops on cyclic references.
+	seen map[dynamicKey]reflect.Value
+}
+
+// dynamicKey is a source pointer with its type: a structure and its first field
+// have the same address.
+type dynamicKey struct {
+	p unsafe.Pointer
+	t reflect.Type
+}
+
+func (d *dynamicConversion) convertPointer(v reflect.Value) reflect.Value {
+	if v.Kind() == reflect.Pointer {
+		if res, ok := d.seen[dynamicKey{unsafe.Pointer(v.Pointer()), v.Type()}]; ok {
+			return res
+		}
+	}
+	converted := convertValue(v, d.maker, Options{Any: true})
+	if converted.IsNil() {
+		return converted
+	}
+	res := reflect.New(converted.Type().Elem())
+	d.seen[dynamicKey{unsafe.Pointer(v.Pointer()), v.Type()}] = res
+	res.Elem().Set(converted.Elem())
+	d.walk(res.Elem())
+	return res
+}
+
+// walk converts dynamic values of interfaces stored in the memory of v.
+func (d *dynamicConversion) walk(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); f.CanSet() {
+				d.walk(f)
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			d.walk(v.Index(i))
+		}
+	case reflect.Interface:
+		if v.IsNil() || v.NumMethod() != 0 {
+			return
+		}
+		dyn := v.Elem()
+		switch {
+		case dyn.Kind() == reflect.Pointer && !dyn.IsNil() && dyn.Type().Elem().Kind() == reflect.Struct:
+			v.Set(d.convertPointer(dyn))
+		case dyn.Kind() == reflect.Struct:
+			p := reflect.New(dyn.Type())
+			p.Elem().Set(dyn)
+			v.Set(d.convertPointer(p).Elem())
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package retag
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// dynamicOuter starts with a structure, so a pointer to the field has the address of the whole.
+type dynamicOuter struct {
+	Xinner FlatStruct
+	XData  interface{}
+	XField interface{}
+}
+
+type dynamicStruct struct {
+	Xport int
+	XData interface{}
+	XArr  [1]interface{}
+	XStr  fmt.Stringer
+}
+
+func TestDynamicConvert(test *testing.T) {
+	marshal := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			test.Fatal(err)
+		}
+		return string(b)
+	}
+	test.Run("Concrete", func(test *testing.T) {
+		p := &dynamicStruct{Xport: 1, XData: &FlatStruct{Omit: 2, Xport: 3}, XArr: [1]interface{}{FlatStruct{Omit: 4, Xport: 5}}}
+		res := DynamicConvert(p, maker{})
+		expected := `{"Xport":1,"XData":{"Xport":3},"XArr":[{"Xport":5}],"XStr":null}`
+		if s := marshal(res); s != expected {
+			test.Errorf("Expect %s but got %s", expected, s)
+		}
+		if _, ok := p.XData.(*FlatStruct); !ok {
+			test.Errorf("The source should not be modified, got %T", p.XData)
+		}
+	})
+	test.Run("Nil", func(test *testing.T) {
+		res := DynamicConvert(&dynamicStruct{}, maker{})
+		if s := marshal(res); s != `{"Xport":0,"XData":null,"XArr":[null],"XStr":null}` {
+			test.Errorf("Unexpected result %s", s)
+		}
+	})
+	test.Run("TypedNil", func(test *testing.T) {
+		res := DynamicConvert((*dynamicStruct)(nil), maker{})
+		if v := reflect.ValueOf(res); !v.IsNil() || v.Type() != reflect.TypeOf(ConvertAny(&dynamicStruct{}, maker{})) {
+			test.Errorf("Expect a nil pointer of the generated type but got %#v", res)
+		}
+	})
+	test.Run("Cyclic", func(test *testing.T) {
+		p := &dynamicStruct{}
+		p.XData = p
+		res := DynamicConvert(p, maker{})
+		if data := reflect.ValueOf(res).Elem().FieldByName("XData").Interface(); data != res {
+			test.Errorf("Expect the cyclic reference to the converted copy but got %T", data)
+		}
+	})
+	test.Run("FirstField", func(test *testing.T) {
+		p := &dynamicOuter{Xinner: FlatStruct{Omit: 1, Xport: 2}}
+		p.XData = p
+		p.XField = &p.Xinner
+		res := DynamicConvert(p, maker{})
+		v := reflect.ValueOf(res).Elem()
+		if data := v.FieldByName("XData").Interface(); data != res {
+			test.Errorf("Expect the cyclic reference to the converted copy but got %T", data)
+		}
+		if s := marshal(v.FieldByName("XField").Interface()); s != `{"Xport":2}` {
+			test.Errorf("Expect the converted field but got %s", s)
+		}
+	})
+}
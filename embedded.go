@@ -0,0 +1,85 @@
+package retag
+
+import (
+	"reflect"
+	"strings"
+)
+
+// checkEmbedded panics with *Error if fields of different embedded structures
+// of the generated type t have the same name in JSON. encoding/json resolves
+// such conflicts by special rules, so retagging can silently change which field wins.
+// Only fields promoted from directly embedded structures are checked.
+func checkEmbedded(source, t reflect.Type) {
+	owners := make(map[string]string)
+	for i := 0; i < t.NumField(); i++ {
+		embedded := t.Field(i)
+		et := embedded.Type
+		if et.Kind() == reflect.Pointer {
+			et = et.Elem()
+		}
+		if !embedded.Anonymous || et.Kind() != reflect.Struct || jsonName(embedded) != embedded.Name {
+			continue
+		}
+		for j := 0; j < et.NumField(); j++ {
+			field := et.Field(j)
+			name := jsonName(field)
+			if name == "" || !field.IsExported() {
+				continue
+			}
+			if owner, ok := owners[name]; ok && owner != embedded.Name {
+				panic(errorf(source, "ambiguous field %q of type %s is promoted from embedded %s and %s",
+					name, source, owner, embedded.Name))
+			}
+			owners[name] = embedded.Name
+		}
+	}
+}
+
+// jsonName returns the name of the field in JSON or "" if the field is omitted.
+func jsonName(field reflect.StructField) string {
+	name := field.Tag.Get("json")
+	if i := strings.Index(name, ","); i >= 0 {
+		name = name[:i]
+	}
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return field.Name
+	}
+	return name
+}
+
+// stripMethods returns the field with a type which brings no methods into
+// the structure being generated, see Options.StripMethods.
+func stripMethods(field reflect.StructField) reflect.StructField {
+	if !field.Anonymous || !hasMethods(field.Type) {
+		return field
+	}
+	t := field.Type
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		field.Anonymous = false
+		return field
+	}
+	fields := make([]reflect.StructField, t.NumField())
+	for i := range fields {
+		fields[i] = stripMethods(t.Field(i))
+	}
+	stripped := reflect.StructOf(fields)
+	if field.Type.Kind() == reflect.Pointer {
+		stripped = reflect.PointerTo(stripped)
+	}
+	field.Type = stripped
+	return field
+}
+
+// hasMethods reports whether the type t or a pointer to it has methods.
+func hasMethods(t reflect.Type) bool {
+	if t.Kind() != reflect.Pointer && t.Kind() != reflect.Interface {
+		t = reflect.PointerTo(t)
+	}
+	return t.NumMethod() > 0
+}
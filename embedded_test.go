@@ -0,0 +1,81 @@
+package retag
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type EmbeddedA struct {
+	ID   int
+	Name string
+}
+
+type EmbeddedB struct {
+	Key   int
+	Title string `json:"name"`
+}
+
+type ambiguous struct {
+	EmbeddedA
+	*EmbeddedB
+}
+
+type unambiguous struct {
+	EmbeddedA
+	B EmbeddedB
+}
+
+// fieldSnaker is the same as Snaker but keeps tags of embedded fields, so they are flattened.
+type fieldSnaker struct{}
+
+func (fieldSnaker) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	if t.Field(fieldIndex).Anonymous {
+		return t.Field(fieldIndex).Tag
+	}
+	return Snaker("json").MakeTag(t, fieldIndex)
+}
+
+func TestCheckEmbedded(test *testing.T) {
+	opts := Options{CheckEmbedded: true}
+	_, err := opts.Convert(new(ambiguous), fieldSnaker{})
+	if err == nil || !strings.Contains(err.Error(), `ambiguous field "name"`) {
+		test.Errorf("Expect error about ambiguous field but got %v", err)
+	}
+	if _, err := opts.Convert(new(ambiguous), Snaker("json")); err != nil {
+		test.Errorf("Unexpected error for named embedded fields: %v", err)
+	}
+	if _, err := opts.Convert(new(unambiguous), fieldSnaker{}); err != nil {
+		test.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := (Options{}).Convert(new(ambiguous), fieldSnaker{}); err != nil {
+		test.Errorf("Unexpected error without the option: %v", err)
+	}
+}
+
+func TestEmbeddedFields(test *testing.T) {
+	p := &struct {
+		EmbeddedA
+		*FlatStruct
+		Extra int
+	}{EmbeddedA{1, "a"}, &FlatStruct{2, 3}, 4}
+	res := Convert(p, fieldSnaker{})
+	generated := reflect.TypeOf(res).Elem()
+	for i, name := range []string{"EmbeddedA", "FlatStruct"} {
+		field := generated.Field(i)
+		if !field.Anonymous || field.Name != name {
+			test.Errorf("Expect the embedded field %s but got %+v", name, field)
+		}
+		ft := field.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if ft == reflect.TypeOf(EmbeddedA{}) || ft == reflect.TypeOf(FlatStruct{}) {
+			test.Errorf("Expect the embedded type %s to be rebuilt", ft)
+		}
+	}
+	(&MapTestCase{Result: `{"i_d":1,"name":"a","omit":2,"xport":3,"extra":4}`}).checkResult(res, test)
+	if v := reflect.ValueOf(res).Elem().FieldByName("Xport"); !v.IsValid() || v.Int() != 3 {
+		test.Errorf("Expect the promoted field Xport=3 but got %v", v)
+	}
+}
@@ -0,0 +1,64 @@
+package retag
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// An Error describes a type which can't be converted.
+// ConvertE and other functions which return errors report failures of a conversion as *Error,
+// Convert and other functions which don't return errors panic with *Error.
+type Error struct {
+	// Type is the type which can't be converted.
+	Type reflect.Type
+	// Msg describes the reason.
+	Msg string
+	// Path locates the failure in the converted type, e.g. Root.Orders[].Handler
+	// (see FieldPath.String). It is empty if the converted type itself can't be converted.
+	Path string
+}
+
+func (e *Error) Error() string {
+	if e.Path != "" {
+		return e.Msg + " (at " + e.Path + ")"
+	}
+	return e.Msg
+}
+
+// errorf makes *Error for the type t. Conversion is aborted by panic with the result.
+func errorf(t reflect.Type, format string, args ...interface{}) *Error {
+	return &Error{Type: t, Msg: fmt.Sprintf(format, args...)}
+}
+
+// catch turns a panic with *Error into the error pointed by err.
+// It must be deferred directly. Other panics are propagated.
+func catch(err *error) {
+	if p := recover(); p != nil {
+		e, ok := p.(*Error)
+		if !ok {
+			panic(p)
+		}
+		*err = e
+	}
+}
+
+// prefixError prefixes the message of a panic with *Error and propagates the panic.
+// It must be deferred directly.
+func prefixError(format string, args ...interface{}) {
+	if p := recover(); p != nil {
+		if err, ok := p.(*Error); ok {
+			res := errorf(err.Type, format+"%s", append(args, err.Msg)...)
+			res.Path = err.Path
+			panic(res)
+		}
+		panic(p)
+	}
+}
+
+// must returns v or panics with err if it is not nil.
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
@@ -0,0 +1,82 @@
+package retag
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// ConvertStream converts the type of the prototype (a pointer to structure) and returns a function
+// which decodes successive JSON values from the dec into fresh instances of the generated type.
+// The type is resolved once, so decoding of a stream of values doesn't pay the conversion cost
+// for every value. Every call of the returned function allocates a new value and returns
+// a pointer to it; the error of the decoder (including io.EOF at the end of the stream)
+// is returned as is.
+//
+// If the prototype is not a pointer to structure or its type can't be converted,
+// the returned function returns an error of type *Error on every call.
+func ConvertStream(dec *json.Decoder, prototype interface{}, maker TagMaker) func() (interface{}, error) {
+	t, err := streamType(prototype, maker)
+	if err != nil {
+		return func() (interface{}, error) { return nil, err }
+	}
+	return func() (interface{}, error) {
+		p := reflect.New(t).Interface()
+		if err := dec.Decode(p); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+}
+
+func streamType(prototype interface{}, maker TagMaker) (t reflect.Type, err error) {
+	defer catch(&err)
+	t = reflect.TypeOf(prototype)
+	if t == nil || t.Kind() != reflect.Pointer || t.Elem().Kind() != reflect.Struct {
+		return nil, errorf(t, "unable to convert %v, because it is not a pointer to structure", t)
+	}
+	return newConversion(maker, Options{}).getType(t.Elem()).t, nil
+}
+
+// DiffMarshal marshals into JSON both the value pointed by p and its converted analogue
+// to show how the maker changes the output. If the source value can't be marshalled as is
+// (e.g. a field which the maker hides has an unsupported type), before is nil and err
+// describes the failure, but after is still returned.
+func DiffMarshal(p interface{}, maker TagMaker) (before, after []byte, err error) {
+	converted, err := ConvertE(p, maker)
+	if err != nil {
+		return nil, nil, err
+	}
+	if after, err = json.Marshal(converted); err != nil {
+		return nil, nil, err
+	}
+	before, err = json.Marshal(p)
+	return before, after, err
+}
+
+// ConvertWithMarshaler converts p in the same way as Convert does and wraps the result
+// into json.Marshaler which marshals the converted value. Generated types have no methods,
+// so the wrapper lets to pass the converted value to APIs which require json.Marshaler.
+//
+// ConvertWithMarshaler panics in the same cases as Convert.
+func ConvertWithMarshaler(p interface{}, maker TagMaker) json.Marshaler {
+	return marshaler{Convert(p, maker)}
+}
+
+type marshaler struct {
+	v interface{}
+}
+
+func (m marshaler) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.v)
+}
+
+// ConvertAndMarshalJSON converts p in the same way as Convert does and marshals the result
+// into JSON by encoding/json. It returns an error of type *Error if p can't be converted,
+// otherwise the error of json.Marshal is returned as is.
+func ConvertAndMarshalJSON(p interface{}, maker TagMaker) ([]byte, error) {
+	converted, err := ConvertE(p, maker)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(converted)
+}
@@ -0,0 +1,124 @@
+package retag
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConvertStream(test *testing.T) {
+	test.Run("Stream", func(test *testing.T) {
+		dec := json.NewDecoder(strings.NewReader(`{"xport":1} {"xport":2,"omit":5} {"xport":3}`))
+		checkStream(test, ConvertStream(dec, new(FlatStruct), Snaker("json")), []int64{1, 2, 3})
+	})
+	test.Run("Array", func(test *testing.T) {
+		dec := json.NewDecoder(strings.NewReader(`[{"xport":1},{"xport":2}]`))
+		if _, err := dec.Token(); err != nil {
+			test.Fatal(err)
+		}
+		next := ConvertStream(dec, new(FlatStruct), Snaker("json"))
+		var values []int64
+		for dec.More() {
+			p, err := next()
+			if err != nil {
+				test.Fatal(err)
+			}
+			values = append(values, reflect.ValueOf(p).Elem().FieldByName("Xport").Int())
+		}
+		if !reflect.DeepEqual(values, []int64{1, 2}) {
+			test.Errorf("Expect %v but got %v", []int64{1, 2}, values)
+		}
+	})
+	test.Run("Errors", func(test *testing.T) {
+		for _, prototype := range []interface{}{nil, FlatStruct{}, new(int), new(struct{ F func() })} {
+			next := ConvertStream(json.NewDecoder(strings.NewReader(`{}`)), prototype, maker{})
+			if _, err := next(); err == nil {
+				test.Errorf("Expect an error for %T", prototype)
+			} else if _, ok := err.(*Error); !ok {
+				test.Errorf("Expect *Error for %T but got %T %v", prototype, err, err)
+			}
+		}
+	})
+}
+
+func checkStream(test *testing.T, next func() (interface{}, error), expected []int64) {
+	var prev interface{}
+	for _, x := range expected {
+		p, err := next()
+		if err != nil {
+			test.Fatal(err)
+		}
+		if p == prev {
+			test.Error("Each value should be decoded into a fresh instance")
+		}
+		prev = p
+		v := reflect.ValueOf(p).Elem()
+		if tag := v.Type().Field(1).Tag; tag != `json:"xport"` {
+			test.Errorf("Unexpected tag `%s`", tag)
+		}
+		if got := v.FieldByName("Xport").Int(); got != x {
+			test.Errorf("Expect %d but got %d", x, got)
+		}
+	}
+	if _, err := next(); err != io.EOF {
+		test.Errorf("Expect EOF but got %v", err)
+	}
+}
+
+func TestDiffMarshal(test *testing.T) {
+	before, after, err := DiffMarshal(&FlatStruct{Omit: 1, Xport: 2}, maker{})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if string(before) != `{"Omit":1,"Xport":2}` || string(after) != `{"Xport":2}` {
+		test.Errorf("Unexpected output `%s` and `%s`", before, after)
+	}
+
+	p := &struct {
+		Omit  map[bool]int
+		Xport int
+	}{Omit: map[bool]int{true: 1}}
+	before, after, err = DiffMarshal(p, maker{})
+	if err == nil || before != nil {
+		test.Errorf("Expect an error for the source but got `%s`", before)
+	}
+	if string(after) != `{"Xport":0}` {
+		test.Errorf("Expect `{\"Xport\":0}` but got `%s`", after)
+	}
+}
+
+func TestConvertWithMarshaler(test *testing.T) {
+	marshal := func(m json.Marshaler) string {
+		b, err := m.MarshalJSON()
+		if err != nil {
+			test.Fatal(err)
+		}
+		return string(b)
+	}
+	p := &FlatStruct{Omit: 1, Xport: 2}
+	if s := marshal(ConvertWithMarshaler(p, maker{})); s != `{"Xport":2}` {
+		test.Errorf("Expect `{\"Xport\":2}` but got `%s`", s)
+	}
+	b, err := json.Marshal(map[string]json.Marshaler{"v": ConvertWithMarshaler(p, maker{})})
+	if err != nil || string(b) != `{"v":{"Xport":2}}` {
+		test.Errorf("Unexpected result `%s`, %v", b, err)
+	}
+}
+
+func TestConvertAndMarshalJSON(test *testing.T) {
+	data, err := ConvertAndMarshalJSON(&FlatStruct{Omit: 1, Xport: 2}, Snaker("json"))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if string(data) != `{"omit":1,"xport":2}` {
+		test.Errorf("Expect `{\"omit\":1,\"xport\":2}` but got `%s`", data)
+	}
+
+	if _, err := ConvertAndMarshalJSON(FlatStruct{}, maker{}); err == nil {
+		test.Error("Expect an error for a value which is not a pointer")
+	} else if _, ok := err.(*Error); !ok {
+		test.Errorf("Expect *Error but got %T", err)
+	}
+}
@@ -0,0 +1,107 @@
+package retag
+
+import (
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+// ConvertLike converts p (a pointer to structure) to the analogue of the template structure type
+// generated by the maker. The type of p must be structurally compatible with the template:
+// it must have the same fields (names and order) of compatible types, so values of the types
+// have the same layout. It lets to share tags between structurally identical types
+// defined in different modules (e.g. vendored or forked copies).
+//
+// ConvertLike returns an error of type *Error describing the first difference
+// if the types are not compatible, or if the template can't be converted.
+func ConvertLike(p interface{}, template reflect.Type, maker TagMaker) (res interface{}, err error) {
+	v := reflect.ValueOf(p)
+	if !v.IsValid() {
+		return nil, errorf(nil, "unable to convert nil, a pointer is expected")
+	}
+	if v.Kind() != reflect.Pointer || v.Type().Elem().Kind() != reflect.Struct {
+		return nil, errorf(v.Type(), "unable to convert %s, because it is not a pointer to structure", v.Type())
+	}
+	source := v.Type().Elem()
+	if diff := compatible(source, template, source.String()); diff != "" {
+		return nil, errorf(source, "type %s is not compatible with %s: %s", source, template, diff)
+	}
+	defer catch(&err)
+	generated := newConversion(maker, Options{}).getType(template)
+	return reflect.NewAt(generated.t, unsafe.Pointer(v.Pointer())).Interface(), nil
+}
+
+// Revert is the inverse of Convert: it reinterprets p (a pointer to a generated type) as
+// a pointer to the original type, e.g. to pass a converted value to code expecting the source type.
+// The result shares memory with p. The original type is the type pointed by the argument of Convert,
+// but any type of the same layout is accepted.
+//
+// Revert panics with *Error if p is not a pointer or the types have different layouts
+// (see ConvertLike).
+func Revert(p interface{}, original reflect.Type) interface{} {
+	v := reflect.ValueOf(p)
+	if v.Kind() != reflect.Pointer {
+		panic(errorf(reflect.TypeOf(p), "unable to revert %v, because it is not a pointer", reflect.TypeOf(p)))
+	}
+	generated := v.Type().Elem()
+	if diff := compatible(generated, original, generated.String()); diff != "" {
+		panic(errorf(generated, "type %s is not compatible with %s: %s", generated, original, diff))
+	}
+	return reflect.NewAt(original, unsafe.Pointer(v.Pointer())).Interface()
+}
+
+// compatible describes the first difference between layouts of the types a and b
+// or returns an empty string if the types are compatible. The path names the compared types.
+func compatible(a, b reflect.Type, path string) string {
+	return compareLayouts(a, b, path, make(map[typePair]bool))
+}
+
+// typePair is a pair of types compared by compareLayouts.
+type typePair struct {
+	a, b reflect.Type
+}
+
+// compareLayouts is compatible which skips the pairs of types in seen. A pair is put into seen
+// before its comparison, so a pair met again (through a cyclic type or a shared one)
+// is treated as compatible: a difference is reported by the first comparison of the pair.
+func compareLayouts(a, b reflect.Type, path string, seen map[typePair]bool) string {
+	if a == b || seen[typePair{a, b}] {
+		return ""
+	}
+	seen[typePair{a, b}] = true
+	if a.Kind() != b.Kind() {
+		return fmt.Sprintf("%s: types %s and %s differ", path, a, b)
+	}
+	switch a.Kind() {
+	case reflect.Struct:
+		if a.NumField() != b.NumField() {
+			return fmt.Sprintf("%s: %d and %d fields", path, a.NumField(), b.NumField())
+		}
+		for i := 0; i < a.NumField(); i++ {
+			fa, fb := a.Field(i), b.Field(i)
+			if fa.Name != fb.Name || fa.Anonymous != fb.Anonymous {
+				return fmt.Sprintf("%s: field %d is %s and %s", path, i, fa.Name, fb.Name)
+			}
+			if diff := compareLayouts(fa.Type, fb.Type, path+"."+fa.Name, seen); diff != "" {
+				return diff
+			}
+		}
+		return "" // compatible fields have the same layout
+	case reflect.Pointer, reflect.Slice:
+		return compareLayouts(a.Elem(), b.Elem(), path+"[]", seen)
+	case reflect.Array:
+		if a.Len() != b.Len() {
+			return fmt.Sprintf("%s: types %s and %s differ", path, a, b)
+		}
+		return compareLayouts(a.Elem(), b.Elem(), path+"[]", seen)
+	case reflect.Map:
+		if diff := compareLayouts(a.Key(), b.Key(), path+"[key]", seen); diff != "" {
+			return diff
+		}
+		return compareLayouts(a.Elem(), b.Elem(), path+"[]", seen)
+	case reflect.Interface, reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return fmt.Sprintf("%s: types %s and %s differ", path, a, b)
+	}
+	// scalars of the same kind have the same representation
+	return ""
+}
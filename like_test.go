@@ -0,0 +1,102 @@
+package retag
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type likeTemplateInner struct {
+	Code string `json:"code"`
+}
+
+type likeTemplate struct {
+	ID    int64             `json:"id"`
+	Inner likeTemplateInner `json:"inner"`
+	List  []*likeTemplateInner
+}
+
+type forkInner struct {
+	Code string
+}
+
+type fork struct {
+	ID    int64
+	Inner forkInner
+	List  []*forkInner
+}
+
+type incompatibleFork struct {
+	ID    int64
+	Inner struct{ Code int }
+	List  []*forkInner
+}
+
+func TestConvertLike(test *testing.T) {
+	p := &fork{ID: 1, Inner: forkInner{"x"}, List: []*forkInner{{"y"}}}
+	res, err := ConvertLike(p, reflect.TypeOf(likeTemplate{}), Snaker("json"))
+	if err != nil {
+		test.Fatal(err)
+	}
+	(&MapTestCase{Result: `{"id":1,"inner":{"code":"x"},"list":[{"code":"y"}]}`}).checkResult(res, test)
+
+	_, err = ConvertLike(new(incompatibleFork), reflect.TypeOf(likeTemplate{}), Snaker("json"))
+	if err == nil || !strings.Contains(err.Error(), "retag.incompatibleFork.Inner.Code: types int and string differ") {
+		test.Errorf("Expect an error with the difference but got %v", err)
+	}
+	if _, err := ConvertLike(fork{}, reflect.TypeOf(likeTemplate{}), Snaker("json")); err == nil {
+		test.Error("Expect an error for a non-pointer")
+	}
+	if _, err := ConvertLike(nil, reflect.TypeOf(likeTemplate{}), Snaker("json")); err == nil || !strings.Contains(err.Error(), "unable to convert nil") {
+		test.Errorf("Expect an error for nil but got %v", err)
+	}
+}
+
+func TestRevert(test *testing.T) {
+	p := &ComplexStruct{XportPtr: &FlatStruct{Omit: 1, Xport: 2}}
+	converted := Convert(p, maker{})
+	reverted, ok := Revert(converted, reflect.TypeOf(ComplexStruct{})).(*ComplexStruct)
+	if !ok || reverted != p {
+		test.Errorf("Expect the source pointer but got %#v", reverted)
+	}
+	test.Run("Incompatible", func(test *testing.T) {
+		defer shouldPanic(test)
+		Revert(converted, reflect.TypeOf(Struct{}))
+	})
+	test.Run("NotPointer", func(test *testing.T) {
+		defer shouldPanic(test)
+		Revert(FlatStruct{}, reflect.TypeOf(FlatStruct{}))
+	})
+}
+
+type likeNodeA struct {
+	Code string
+	Next *likeNodeA
+}
+
+type likeNodeB struct {
+	Code string     `json:"code"`
+	Next *likeNodeB `json:"next"`
+}
+
+type likeNodeC struct {
+	Code int
+	Next *likeNodeC
+}
+
+func TestConvertLikeCyclic(test *testing.T) {
+	p := &likeNodeA{Code: "x", Next: &likeNodeA{Code: "y"}}
+	res, err := ConvertLike(p, reflect.TypeOf(likeNodeB{}), Snaker("json"))
+	if err != nil {
+		test.Fatal(err)
+	}
+	(&MapTestCase{Result: `{"code":"x","next":{"code":"y","next":null}}`}).checkResult(res, test)
+
+	_, err = ConvertLike(new(likeNodeC), reflect.TypeOf(likeNodeB{}), Snaker("json"))
+	if err == nil || !strings.Contains(err.Error(), "retag.likeNodeC.Code: types int and string differ") {
+		test.Errorf("Expect an error with the difference but got %v", err)
+	}
+	if reverted, ok := Revert(res, reflect.TypeOf(likeNodeA{})).(*likeNodeA); !ok || reverted != p {
+		test.Errorf("Expect the source pointer but got %#v", reverted)
+	}
+}
@@ -0,0 +1,349 @@
+package retag
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// CopyTagsFrom creates TagMaker which copies tags of fields of the source structure
+// to the same-named fields of the target structure. Fields of the target which have no
+// counterpart in the source keep their tags, as well as fields of other structures
+// met during conversion.
+//
+// It lets to maintain the only annotated structure and project its tags to structurally
+// similar types. CopyTagsFrom returns an error if either of the types is not a structure.
+func CopyTagsFrom(target, source reflect.Type) (TagMaker, error) {
+	for _, t := range []reflect.Type{target, source} {
+		if t.Kind() != reflect.Struct {
+			return nil, errorf(t, "retag: unable to copy tags, because %s is not a structure", t)
+		}
+	}
+	return tagCopier{target, source}, nil
+}
+
+// MustCopyTagsFrom is like CopyTagsFrom but panics if either of the types is not a structure.
+// It simplifies initialization of global variables holding makers.
+func MustCopyTagsFrom(target, source reflect.Type) TagMaker {
+	return must(CopyTagsFrom(target, source))
+}
+
+type tagCopier struct {
+	target reflect.Type
+	source reflect.Type
+}
+
+func (c tagCopier) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	field := t.Field(fieldIndex)
+	if t != c.target {
+		return field.Tag
+	}
+	if sourceField, ok := c.source.FieldByName(field.Name); ok {
+		return sourceField.Tag
+	}
+	return field.Tag
+}
+
+// EnvOverrideMaker is a TagMaker which makes tags by the Base maker and then replaces
+// tags of fields listed in Overrides (by name of a field). It lets to tweak tags
+// for a specific environment (e.g. staging or production) in a single binary.
+//
+// EnvOverrideMaker is not comparable because of the map, so it implements TagMaker
+// by a pointer, and the pointer is used as a key of the cache.
+// The maker should not be modified after the first conversion.
+type EnvOverrideMaker struct {
+	Base      TagMaker
+	Overrides map[string]reflect.StructTag
+}
+
+func (m *EnvOverrideMaker) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	if tag, ok := m.Overrides[t.Field(fieldIndex).Name]; ok {
+		return tag
+	}
+	return m.Base.MakeTag(t, fieldIndex)
+}
+
+// TypeNameMaker is a TagMaker which adds to the tag of every field the key Key
+// with the Go type name of the source field (e.g. `type:"time.Time"`). Other keys of the tag are kept.
+type TypeNameMaker struct {
+	Key string
+}
+
+func (m TypeNameMaker) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	return m.MakeResolvedTag(newFieldInfo(t, fieldIndex, t.Field(fieldIndex).Type))
+}
+
+func (m TypeNameMaker) MakeResolvedTag(field FieldInfo) reflect.StructTag {
+	return setTagValue(field.Field.Tag, m.Key, field.Field.Type.String())
+}
+
+// NewSQLXMaker creates TagMaker which makes `db:"column_name"` tags expected by github.com/jmoiron/sqlx.
+// See SQL makers notes in NewSQLBoilerMaker.
+func NewSQLXMaker() TagMaker {
+	return sqlMaker{"db"}
+}
+
+// NewSQLBoilerMaker creates TagMaker which makes `boil:"column_name"` tags expected
+// by github.com/volatiletech/sqlboiler.
+//
+// The column name is the name of a field in snake case unless the tag already has a value for the key.
+// Fields of pointer and sql.Null* types are marked as nullable by the option ",nullable"
+// (e.g. `boil:"deleted_at,nullable"`), the libraries skip options of the column name.
+// Other keys of tags are kept.
+func NewSQLBoilerMaker() TagMaker {
+	return sqlMaker{"boil"}
+}
+
+type sqlMaker struct {
+	key string
+}
+
+func (m sqlMaker) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	field := t.Field(fieldIndex)
+	name := field.Tag.Get(m.key)
+	if name == "" {
+		name = snakeCase(field.Name)
+		if isNullable(field.Type) {
+			name += ",nullable"
+		}
+	}
+	return setTagValue(field.Tag, m.key, name)
+}
+
+func isNullable(t reflect.Type) bool {
+	return t.Kind() == reflect.Pointer || sqlNullTypes[t]
+}
+
+// snakeCase converts the name of a field into snake case keeping acronyms together,
+// e.g. "CardNumber" -> "card_number", "UserID" -> "user_id", "HTTPServer" -> "http_server".
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				prev := runes[i-1]
+				nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+				if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextIsLower) {
+					b.WriteByte('_')
+				}
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// JSONMaker is a TagMaker which adjusts json tags of fields according to its options.
+// Names and options of existing json tags and other keys of tags are kept.
+type JSONMaker struct {
+	// StringNumbers adds the ",string" option to json tags of fields of integer,
+	// floating point and bool types, so the values are transmitted as JSON strings.
+	StringNumbers bool
+}
+
+func (m JSONMaker) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	return m.MakeResolvedTag(newFieldInfo(t, fieldIndex, t.Field(fieldIndex).Type))
+}
+
+func (m JSONMaker) MakeResolvedTag(field FieldInfo) reflect.StructTag {
+	tag := field.Field.Tag
+	value, _ := tag.Lookup("json")
+	if value == "-" {
+		return tag
+	}
+	if m.StringNumbers && isStringable(field.Type.Kind()) && !hasTagOption(value, "string") {
+		value += ",string"
+	}
+	if value == "" {
+		return tag
+	}
+	return setTagValue(tag, "json", value)
+}
+
+// isStringable reports whether encoding/json supports the ",string" option for the numeric kind.
+func isStringable(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// hasTagOption reports whether the tag value (e.g. "name,omitempty") has the option.
+func hasTagOption(value, option string) bool {
+	options := strings.Split(value, ",")[1:]
+	return stringList(options).contains(option)
+}
+
+// NewJSONTagMaker creates TagMaker which sets the name in json tags of fields to fn(name of a field).
+// Options of existing json tags (e.g. ",omitempty") and other keys of tags are kept,
+// fields hidden by `json:"-"` stay hidden.
+//
+// Functions are not comparable, so the maker is a pointer and every call of NewJSONTagMaker
+// creates a new key of the cache. Create the maker once and reuse it.
+func NewJSONTagMaker(fn func(fieldName string) string) TagMaker {
+	return &jsonRenamer{fn}
+}
+
+// NewJSONSnakeCaseMaker creates TagMaker which sets the name in json tags of fields to the name
+// of a field in snake case (e.g. "UserID" -> "user_id") in the same way as NewJSONTagMaker does.
+// The maker is comparable, so all the makers share the cache.
+func NewJSONSnakeCaseMaker() TagMaker {
+	return jsonSnakeCaseMaker{}
+}
+
+type jsonRenamer struct {
+	fn func(string) string
+}
+
+func (m *jsonRenamer) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	return renameJSON(t.Field(fieldIndex), m.fn)
+}
+
+type jsonSnakeCaseMaker struct{}
+
+func (jsonSnakeCaseMaker) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	return renameJSON(t.Field(fieldIndex), snakeCase)
+}
+
+func renameJSON(field reflect.StructField, fn func(string) string) reflect.StructTag {
+	value, _ := field.Tag.Lookup("json")
+	if value == "-" {
+		return field.Tag
+	}
+	name := fn(field.Name)
+	if i := strings.IndexByte(value, ','); i >= 0 {
+		name += value[i:]
+	}
+	return setTagValue(field.Tag, "json", name)
+}
+
+// NewCompositeTagMaker creates TagMaker which merges tags made by the makers for every field:
+// keys of all the tags are combined into a single tag, later makers win on key conflicts.
+// A maker returning KeepTag contributes the original tag of the field.
+// The merged tag panics with *Error if a maker makes a malformed tag.
+//
+// The makers are called as the conversion calls them: MakeResolvedTag of ResolvedTagMaker
+// and TransformTag of TagTransformer are called instead of MakeTag. PathAwareTagMaker is not supported,
+// a composite doesn't know the path of the field.
+//
+// The makers must be comparable, IdentifiedTagMaker too: a composite is identified by the makers themselves.
+// Composites of the same makers are the same maker, so they share the cache.
+// NewCompositeTagMaker panics with *Error if a maker is nil, not comparable or PathAwareTagMaker.
+func NewCompositeTagMaker(makers ...TagMaker) TagMaker {
+	c := emptyComposite
+	for _, maker := range makers {
+		checkMaker(maker)
+		t := reflect.TypeOf(maker)
+		checkComparable(t)
+		if _, ok := maker.(PathAwareTagMaker); ok {
+			panic(errorf(t, "retag: PathAwareTagMaker %s can't be a part of a composite maker", t))
+		}
+		c = c.add(maker)
+	}
+	return c
+}
+
+// compositeMaker is an interned list of makers, so it is comparable by the pointer.
+// The list starts with emptyComposite.
+type compositeMaker struct {
+	parent *compositeMaker
+	maker  TagMaker
+}
+
+var emptyComposite = &compositeMaker{}
+
+var compositeMakers = struct {
+	sync.Mutex
+	m map[compositeMaker]*compositeMaker
+}{
+	m: make(map[compositeMaker]*compositeMaker),
+}
+
+func (c *compositeMaker) add(maker TagMaker) *compositeMaker {
+	key := compositeMaker{c, maker}
+	compositeMakers.Lock()
+	defer compositeMakers.Unlock()
+	res, ok := compositeMakers.m[key]
+	if !ok {
+		res = &key
+		compositeMakers.m[key] = res
+	}
+	return res
+}
+
+func (c *compositeMaker) makers() []TagMaker {
+	var makers []TagMaker
+	for ; c != emptyComposite; c = c.parent {
+		makers = append(makers, c.maker)
+	}
+	for i, j := 0, len(makers)-1; i < j; i, j = i+1, j-1 {
+		makers[i], makers[j] = makers[j], makers[i]
+	}
+	return makers
+}
+
+func (c *compositeMaker) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	return c.MakeResolvedTag(newFieldInfo(t, fieldIndex, t.Field(fieldIndex).Type))
+}
+
+func (c *compositeMaker) MakeResolvedTag(field FieldInfo) reflect.StructTag {
+	if c == emptyComposite {
+		return KeepTag
+	}
+	t, fieldIndex := field.Struct, field.Index
+	original := field.Field.Tag
+	var merged []TagPair
+	for _, maker := range c.makers() {
+		tag := makeFieldTag(maker, field)
+		if tag == KeepTag {
+			tag = original
+		}
+		pairs, err := ParseStructTag(tag)
+		if err != nil {
+			panic(errorf(t, "retag: unable to merge tag `%s` of the field %s of %s, because it is malformed", tag, t.Field(fieldIndex).Name, t))
+		}
+	next:
+		for _, pair := range pairs {
+			for i := range merged {
+				if merged[i].Key == pair.Key {
+					merged[i].Value = pair.Value
+					continue next
+				}
+			}
+			merged = append(merged, pair)
+		}
+	}
+	return SerializeStructTag(merged)
+}
+
+// NewMergeTagMaker creates TagMaker which replaces the value of the key in tags of fields
+// with fn(old value) and keeps other keys of tags in their order. The old value is empty
+// if the tag has no such key; the key is not added if fn returns an empty string for it.
+//
+// Functions are not comparable, so the maker is a pointer and every call of NewMergeTagMaker
+// creates a new key of the cache. Create the maker once and reuse it.
+func NewMergeTagMaker(key string, fn func(old string) string) TagMaker {
+	return &tagMerger{key, fn}
+}
+
+type tagMerger struct {
+	key string
+	fn  func(string) string
+}
+
+func (m *tagMerger) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	tag := t.Field(fieldIndex).Tag
+	old, ok := tag.Lookup(m.key)
+	value := m.fn(old)
+	if !ok && value == "" {
+		return tag
+	}
+	return setTagValue(tag, m.key, value)
+}
@@ -0,0 +1,259 @@
+package retag
+
+import (
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type annotatedProfile struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name,omitempty"`
+	Password string `json:"-"`
+}
+
+type plainProfile struct {
+	ID       int64
+	Name     string
+	Password string
+	Extra    string `json:"extra"`
+}
+
+func TestCopyTagsFrom(test *testing.T) {
+	maker, err := CopyTagsFrom(reflect.TypeOf(plainProfile{}), reflect.TypeOf(annotatedProfile{}))
+	if err != nil {
+		test.Fatal(err)
+	}
+	p := &plainProfile{ID: 1, Name: "Duke", Password: "secret", Extra: "x"}
+	(&MapTestCase{Result: `{"id":1,"name":"Duke","extra":"x"}`}).checkResult(Convert(p, maker), test)
+
+	if _, err := CopyTagsFrom(reflect.TypeOf(plainProfile{}), reflect.TypeOf("")); err == nil {
+		test.Error("Expect an error for a non-structure type")
+	}
+}
+
+func TestEnvOverrideMaker(test *testing.T) {
+	maker := &EnvOverrideMaker{
+		Base:      Snaker("json"),
+		Overrides: map[string]reflect.StructTag{"Password": `json:"-"`},
+	}
+	p := &plainProfile{ID: 1, Name: "Duke", Password: "secret"}
+	(&MapTestCase{Result: `{"i_d":1,"name":"Duke","extra":""}`}).checkResult(Convert(p, maker), test)
+}
+
+func TestMustCopyTagsFrom(test *testing.T) {
+	if m := MustCopyTagsFrom(reflect.TypeOf(plainProfile{}), reflect.TypeOf(annotatedProfile{})); m == nil {
+		test.Error("Expect maker")
+	}
+	defer shouldPanic(test)
+	MustCopyTagsFrom(reflect.TypeOf(plainProfile{}), reflect.TypeOf(0))
+}
+
+func TestTypeNameMaker(test *testing.T) {
+	type Event struct {
+		ID   int64     `json:"id"`
+		At   time.Time `json:"at"`
+		Tags []string
+		Next *FlatStruct
+	}
+	result := reflect.TypeOf(Convert(new(Event), TypeNameMaker{"type"})).Elem()
+	expected := []reflect.StructTag{
+		`json:"id" type:"int64"`,
+		`json:"at" type:"time.Time"`,
+		`type:"[]string"`,
+		`type:"*retag.FlatStruct"`,
+	}
+	for i, tag := range expected {
+		if got := result.Field(i).Tag; got != tag {
+			test.Errorf("Expect `%s` but got `%s`", tag, got)
+		}
+	}
+	if tag := result.Field(3).Type.Elem().Field(0).Tag; tag != `type:"int"` {
+		test.Errorf("Expect nested field to be tagged but got `%s`", tag)
+	}
+}
+
+func TestSnakeCase(test *testing.T) {
+	cases := map[string]string{
+		"":           "",
+		"Name":       "name",
+		"CardNumber": "card_number",
+		"ID":         "id",
+		"UserID":     "user_id",
+		"HTTPServer": "http_server",
+		"Address2":   "address2",
+		"V2Config":   "v2_config",
+	}
+	for name, expected := range cases {
+		if got := snakeCase(name); got != expected {
+			test.Errorf("Expect %q but got %q for %q", expected, got, name)
+		}
+	}
+}
+
+type sqlUser struct {
+	ID        int64
+	Name      string `json:"name"`
+	Nick      sql.NullString
+	DeletedAt *time.Time
+	Email     string `db:"mail"`
+}
+
+func TestSQLMakers(test *testing.T) {
+	cases := []struct {
+		maker TagMaker
+		tags  []reflect.StructTag
+	}{
+		{NewSQLXMaker(), []reflect.StructTag{
+			`db:"id"`,
+			`json:"name" db:"name"`,
+			`db:"nick,nullable"`,
+			`db:"deleted_at,nullable"`,
+			`db:"mail"`,
+		}},
+		{NewSQLBoilerMaker(), []reflect.StructTag{
+			`boil:"id"`,
+			`json:"name" boil:"name"`,
+			`boil:"nick,nullable"`,
+			`boil:"deleted_at,nullable"`,
+			`db:"mail" boil:"email"`,
+		}},
+	}
+	for _, c := range cases {
+		t := reflect.TypeOf(Convert(new(sqlUser), c.maker)).Elem()
+		for i, tag := range c.tags {
+			if got := t.Field(i).Tag; got != tag {
+				test.Errorf("Expect `%s` but got `%s`", tag, got)
+			}
+		}
+		if t.Field(2).Type != reflect.TypeOf(sql.NullString{}) {
+			test.Errorf("Expect sql.NullString to be kept but got %s", t.Field(2).Type)
+		}
+	}
+}
+
+func TestJSONMaker_StringNumbers(test *testing.T) {
+	type Payment struct {
+		ID       int64 `json:"id"`
+		Amount   float64
+		Paid     bool `json:",omitempty"`
+		Currency string
+		Secret   int `json:"-"`
+		Count    int `json:"count,string"`
+	}
+	p := &Payment{ID: 10, Amount: 1.5, Paid: true, Currency: "EUR", Secret: 7, Count: 2}
+	result := Convert(p, JSONMaker{StringNumbers: true})
+	expected := `{"id":"10","Amount":"1.5","Paid":"true","Currency":"EUR","count":"2"}`
+	(&MapTestCase{Result: expected}).checkResult(result, test)
+	if tag := reflect.TypeOf(result).Elem().Field(3).Tag; tag != "" {
+		test.Errorf("Expect no tag for string field but got `%s`", tag)
+	}
+}
+
+func TestJSONTagMaker(test *testing.T) {
+	type User struct {
+		UserID   int    `json:"id,omitempty" db:"id"`
+		FullName string `json:",omitempty"`
+		Password string `json:"-"`
+		Email    string
+	}
+	p := &User{UserID: 1, FullName: "Bob", Password: "secret", Email: "bob@example.com"}
+	result := Convert(p, NewJSONSnakeCaseMaker())
+	(&MapTestCase{Result: `{"user_id":1,"full_name":"Bob","email":"bob@example.com"}`}).checkResult(result, test)
+	if tag := reflect.TypeOf(result).Elem().Field(0).Tag; tag != `json:"user_id,omitempty" db:"id"` {
+		test.Errorf("Unexpected tag `%s`", tag)
+	}
+
+	upper := NewJSONTagMaker(strings.ToUpper)
+	result = Convert(p, upper)
+	(&MapTestCase{Result: `{"USERID":1,"FULLNAME":"Bob","EMAIL":"bob@example.com"}`}).checkResult(result, test)
+	if t := reflect.TypeOf(Convert(p, upper)); t != reflect.TypeOf(result) {
+		test.Errorf("Expect the same type for the same maker but got %s", t)
+	}
+}
+
+type validateMaker struct{}
+
+func (validateMaker) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	if t.Field(fieldIndex).Type.Kind() != reflect.String {
+		return KeepTag
+	}
+	return `validate:"required" json:"overridden"`
+}
+
+func TestCompositeTagMaker(test *testing.T) {
+	type Account struct {
+		Name  string `db:"name"`
+		Level int
+	}
+	maker := NewCompositeTagMaker(NewJSONSnakeCaseMaker(), validateMaker{})
+	if other := NewCompositeTagMaker(NewJSONSnakeCaseMaker(), validateMaker{}); other != maker {
+		test.Error("Expect composites of the same makers to be equal")
+	}
+	generated := reflect.TypeOf(Convert(new(Account), maker)).Elem()
+	expected := []reflect.StructTag{`db:"name" json:"overridden" validate:"required"`, `json:"level"`}
+	for i, tag := range expected {
+		if got := generated.Field(i).Tag; got != tag {
+			test.Errorf("Expect `%s` but got `%s`", tag, got)
+		}
+	}
+	if t := reflect.TypeOf(Convert(new(Account), NewCompositeTagMaker())).Elem(); t != reflect.TypeOf(Account{}) {
+		test.Errorf("Expect the empty composite to keep tags but got %s", t)
+	}
+
+	test.Run("ResolvedAndTransformer", func(test *testing.T) {
+		type Row struct {
+			A [60]byte `json:"a"`
+			B [8]byte  `json:"b"` // [60, 68), split
+		}
+		generated := reflect.TypeOf(Convert(new(Row), NewCompositeTagMaker(cacheLineMaker{}, omitEmptier{}))).Elem()
+		expected := []reflect.StructTag{`json:"a,omitempty"`, `cacheline:"split" json:"b,omitempty"`}
+		for i, tag := range expected {
+			if got := generated.Field(i).Tag; got != tag {
+				test.Errorf("Expect `%s` but got `%s`", tag, got)
+			}
+		}
+	})
+	for name, child := range map[string]TagMaker{"Nil": nil, "NotComparable": sliceMaker{}, "PathAware": sliceOmitter{}} {
+		test.Run(name, func(test *testing.T) {
+			defer func() {
+				if _, ok := recover().(*Error); !ok {
+					test.Errorf("Expect a panic with *Error for the maker %#v", child)
+				}
+			}()
+			NewCompositeTagMaker(validateMaker{}, child)
+		})
+	}
+}
+
+func TestMergeTagMaker(test *testing.T) {
+	type Document struct {
+		Title  string `yaml:"title" json:"title,omitempty" validate:"max=10"`
+		Quote  string `json:"say \"hi\"" db:"a b"`
+		Plain  string
+		Hidden string `json:"-"`
+	}
+	maker := NewMergeTagMaker("json", func(old string) string {
+		if old == "" || old == "-" {
+			return old
+		}
+		return "x_" + old
+	})
+	generated := reflect.TypeOf(Convert(new(Document), maker)).Elem()
+	expected := []reflect.StructTag{
+		`yaml:"title" json:"x_title,omitempty" validate:"max=10"`,
+		`json:"x_say \"hi\"" db:"a b"`,
+		``,
+		`json:"-"`,
+	}
+	for i, tag := range expected {
+		if got := generated.Field(i).Tag; got != tag {
+			test.Errorf("Expect `%s` but got `%s`", tag, got)
+		}
+	}
+	if value := generated.Field(1).Tag.Get("json"); value != `x_say "hi"` {
+		test.Errorf("Unexpected value %q", value)
+	}
+}
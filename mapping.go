@@ -0,0 +1,47 @@
+package retag
+
+import (
+	"reflect"
+	"strings"
+)
+
+// NameMapping returns a map from names of fields of the structure type t to names
+// from the primary (the first) key of tags generated by the maker, e.g. names in json tags.
+// Options of the tag value (after a comma) are dropped. A field the maker leaves
+// without a name is mapped to its Go name. Unexported and blank fields are not
+// mapped. It lets to translate between internal and wire names without parsing of tags.
+//
+// NameMapping returns an error if t is not a structure or can't be converted.
+func NameMapping(t reflect.Type, maker TagMaker) (m map[string]string, err error) {
+	if t.Kind() != reflect.Struct {
+		return nil, errorf(t, "retag: unable to map names of %s, because it is not a structure", t)
+	}
+	defer catch(&err)
+	res := newConversion(maker, Options{}).getType(t)
+	m = make(map[string]string, res.t.NumField())
+	for i := 0; i < res.t.NumField(); i++ {
+		field := res.t.Field(i)
+		if field.PkgPath != "" || field.Name == "_" {
+			continue
+		}
+		name := primaryTagName(field.Tag)
+		if name == "" {
+			name = field.Name
+		}
+		m[field.Name] = name
+	}
+	return m, nil
+}
+
+// primaryTagName returns the value of the first key of the tag without options.
+func primaryTagName(tag reflect.StructTag) string {
+	pairs, err := ParseStructTag(tag)
+	if err != nil || len(pairs) == 0 {
+		return ""
+	}
+	value := pairs[0].Value
+	if i := strings.Index(value, ","); i >= 0 {
+		value = value[:i]
+	}
+	return value
+}
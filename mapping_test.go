@@ -0,0 +1,53 @@
+package retag
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNameMapping(test *testing.T) {
+	type Profile struct {
+		ID          int64 `json:"_id,omitempty"`
+		Name        string
+		CardNumber  string
+		SupportNote string
+		_           int
+	}
+	m, err := NameMapping(reflect.TypeOf(Profile{}), Snaker("json"))
+	if err != nil {
+		test.Fatal(err)
+	}
+	expected := map[string]string{
+		"ID":          "_id",
+		"Name":        "name",
+		"CardNumber":  "card_number",
+		"SupportNote": "support_note",
+	}
+	if !reflect.DeepEqual(m, expected) {
+		test.Errorf("Expect %v but got %v", expected, m)
+	}
+
+	m, err = NameMapping(reflect.TypeOf(FlatStruct{}), maker{})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if expected := map[string]string{"Omit": "-", "Xport": "Xport"}; !reflect.DeepEqual(m, expected) {
+		test.Errorf("Expect %v but got %v", expected, m)
+	}
+
+	type Account struct {
+		Name   string `json:"name"`
+		secret string
+	}
+	m, err = NameMapping(reflect.TypeOf(Account{}), NewCompositeTagMaker())
+	if err != nil {
+		test.Fatal(err)
+	}
+	if expected := map[string]string{"Name": "name"}; !reflect.DeepEqual(m, expected) {
+		test.Errorf("Expect %v but got %v", expected, m)
+	}
+
+	if _, err := NameMapping(reflect.TypeOf(0), maker{}); err == nil {
+		test.Error("Expect an error for a non-structure type")
+	}
+}
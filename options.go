@@ -0,0 +1,312 @@
+package retag
+
+import (
+	"context"
+	"reflect"
+	"sync"
+)
+
+// Options control the conversion. The zero value of Options means
+// the same behaviour as the behaviour of the Convert function.
+//
+// Generated types are cached separately for different options.
+type Options struct {
+	// Any leaves fields of interface types unchanged instead of panic, as ConvertAny does.
+	Any bool
+	// InterfaceCopy leaves fields of interface types unchanged as Any does, but the value
+	// of a type with interfaces is copied to a new location instead of sharing memory with
+	// the source, so the source can be modified or released independently. Only the value pointed
+	// by the argument is copied, values referred by its pointers, slices and maps are still shared.
+	// The layout of the types is the same in both cases, interface values are copied as is.
+	InterfaceCopy bool
+	// PassthroughUnsupported leaves fields of chan, func and unsafe.Pointer types
+	// unchanged instead of panic. Interfaces are controlled by Any.
+	PassthroughUnsupported bool
+	// MaxFields limits the number of fields of every converted structure,
+	// a structure with more fields is reported as an error. Zero means no limit.
+	// It protects from machine-generated structures with an excessive number of fields.
+	MaxFields int
+	// MaxDepth limits the nesting depth of types: every structure, pointer, slice, array
+	// and map is a level, so a structure with a field of type []*T has the depth 4 if T is
+	// a structure without nested types. A deeper type is reported as an error instead
+	// of exhausting the stack. Zero means no limit.
+	MaxDepth int
+	// Unexported chooses how to handle structures with unexported fields
+	// which tags should be changed, see UnexportedStrategy.
+	Unexported UnexportedStrategy
+	// ElemMaker, if not nil, is used instead of the maker for structures reached through
+	// elements of slices and arrays (and for all types nested into them).
+	ElemMaker TagMaker
+	// CheckEmbedded reports an error if fields promoted from different embedded structures
+	// of a generated type have the same name in JSON, because encoding/json resolves
+	// such conflicts by its own rules and retagging can change which field wins.
+	CheckEmbedded bool
+	// StripMethods removes methods promoted from embedded fields of generated structures.
+	// By default a generated structure keeps the embedded types as they are, so it gets their
+	// methods like reflect.StructOf allows; but reflect.StructOf panics if an embedded type
+	// with methods is not the first field, or if an embedded pointer with methods is accompanied
+	// by other fields. With StripMethods an embedded structure with methods is replaced with
+	// an unnamed structure of the same fields and other embedded types with methods become
+	// ordinary fields of the same name, so the conversion survives such structures.
+	// Note the methods include marshalers (e.g. time.Time.MarshalJSON), the stripped fields
+	// are encoded by their fields instead.
+	StripMethods bool
+	// NoCache bypasses the cache of generated types: every type is generated again
+	// and the result is not stored. It is useful for tests and for makers which are
+	// not deterministic. Cyclic types are still handled by the guard of the current path,
+	// but repeated types are generated again for every occurrence.
+	NoCache bool
+	// opaque is the set of types which are not modified in addition to
+	// the types registered by RegisterOpaqueType, see WithOpaqueTypes.
+	opaque *opaqueList
+	// fields is the set of names of fields which tags are made by the maker,
+	// all fields if it is nil, see WithFields.
+	fields *fieldList
+	// ValidateTags reports a tag made by the maker as an error if it is not a well-formed
+	// sequence of key:"value" pairs by the rules of reflect.StructTag.Lookup.
+	// Otherwise a malformed tag gets into the generated type and the keys are silently ignored.
+	// Tags of fields the maker leaves with KeepTag or doesn't see (see WithFields) are not validated.
+	// A malformed tag the maker returns unchanged is reported as an error of the source type.
+	ValidateTags bool
+	// SizePadding appends a padding field to a generated structure which is smaller than
+	// the source one (e.g. reflect.StructOf of go1.7 doesn't pad a final zero-size field),
+	// so the generated type has the size of the source one instead of panic.
+	// The padding is a blank field of a byte array type tagged `json:"-"`.
+	SizePadding bool
+	// Logger receives debug messages about the conversion: cache hits and misses,
+	// generated types and changes of tags. Nothing is logged if Logger is nil.
+	// Logger doesn't affect generated types, so it is not a part of a key of the cache.
+	Logger Logger
+	// structTags adds marker fields of StructTagMaker. Such types don't have the layout
+	// of the source ones, so they are used for copies only, see DeepConvert.
+	structTags bool
+	// ctx is set by ConvertContext, it is not a part of a key of the cache.
+	ctx context.Context
+	// fieldHook is set by WithFieldHook. Functions are not comparable,
+	// so it is a pointer which keeps the options comparable.
+	fieldHook *fieldHook
+}
+
+type fieldHook func(structType reflect.Type, fieldIndex int, oldTag, newTag reflect.StructTag)
+
+// A Logger is used by the conversion to write debug messages.
+// *log.Logger implements the interface.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// keyed returns the options which affect generated types.
+// They are a part of a key of the cache, so they must be comparable.
+func (o Options) keyed() Options {
+	o.Logger = nil
+	o.fieldHook = nil
+	o.ctx = nil
+	return o
+}
+
+// affectNothing reports whether the keyed options are the default ones. It is the hit path
+// of the cache, comparison of the whole options costs as much as the lookup, so the fields
+// are checked one by one; TestOptionsAffectNothing verifies that every keyed field is checked.
+func (o *Options) affectNothing() bool {
+	return !o.Any && !o.InterfaceCopy && !o.PassthroughUnsupported && o.MaxFields == 0 && o.MaxDepth == 0 &&
+		o.Unexported == 0 && o.ElemMaker == nil && !o.CheckEmbedded && !o.StripMethods && !o.NoCache &&
+		o.opaque == nil && o.fields == nil && !o.ValidateTags && !o.SizePadding && !o.structTags
+}
+
+// Convert converts p in the same way as ConvertE does, but respects the options.
+func (o Options) Convert(p interface{}, maker TagMaker) (res interface{}, err error) {
+	defer catch(&err)
+	return convert(p, maker, o), nil
+}
+
+// An UnexportedStrategy is a way to handle a structure with unexported fields
+// if the maker changes tags of its exported fields.
+type UnexportedStrategy int
+
+const (
+	// UnexportedPanic reports such a structure as *Error: Convert panics and
+	// functions returning errors return it. It is the default.
+	UnexportedPanic UnexportedStrategy = iota
+	// UnexportedSkip leaves such a structure unchanged, so its tags are not changed.
+	UnexportedSkip
+	// UnexportedKeep generates the structure with the unexported fields kept as they are.
+	// reflect.StructOf supports unexported fields since go1.8, in go1.7 it is the same
+	// as UnexportedPanic.
+	UnexportedKeep
+)
+
+// An Option changes the Options of a conversion, see ConvertWith.
+type Option func(*Options)
+
+// WithAny leaves fields of interface types unchanged instead of panic, as ConvertAny does.
+func WithAny() Option {
+	return func(o *Options) { o.Any = true }
+}
+
+// WithInterfaceCopy converts types with interfaces by copying, see Options.InterfaceCopy.
+func WithInterfaceCopy() Option {
+	return func(o *Options) { o.InterfaceCopy = true }
+}
+
+// WithFields lets the maker to make tags of fields of the names only, other fields
+// of all structures keep their original tags as if the maker returned KeepTag for them.
+// Types of all fields are still converted, so a structure is generated if it has a selected field
+// which tag is changed or a field of a type which has its own analogue.
+// WithFields without names has no effect.
+func WithFields(names ...string) Option {
+	return func(o *Options) {
+		for _, name := range names {
+			o.fields = o.fields.add(name)
+		}
+	}
+}
+
+// WithPassthroughUnsupported leaves fields of chan, func and unsafe.Pointer types unchanged
+// instead of panic, see Options.PassthroughUnsupported.
+func WithPassthroughUnsupported() Option {
+	return func(o *Options) { o.PassthroughUnsupported = true }
+}
+
+// WithOpaqueTypes treats the types as opaque ones for this conversion only,
+// so they are not modified in the same way as types registered by RegisterOpaqueType.
+func WithOpaqueTypes(types ...reflect.Type) Option {
+	return func(o *Options) {
+		for _, t := range types {
+			o.opaque = o.opaque.add(t)
+		}
+	}
+}
+
+// WithMaxDepth limits the nesting depth of types, see Options.MaxDepth.
+func WithMaxDepth(n int) Option {
+	return func(o *Options) { o.MaxDepth = n }
+}
+
+// WithUnexportedStrategy chooses how to handle structures with unexported fields, see Options.Unexported.
+func WithUnexportedStrategy(strategy UnexportedStrategy) Option {
+	return func(o *Options) { o.Unexported = strategy }
+}
+
+// WithValidateTags reports malformed tags made by the maker, see Options.ValidateTags.
+func WithValidateTags() Option {
+	return func(o *Options) { o.ValidateTags = true }
+}
+
+// WithSizePadding pads generated structures to the size of the source ones, see Options.SizePadding.
+func WithSizePadding() Option {
+	return func(o *Options) { o.SizePadding = true }
+}
+
+// WithFieldHook sets the hook called for every exported field of a structure being converted
+// with the original tag and the tag made by the maker, e.g. to count changes of tags or
+// to investigate why a field is not retagged. The hook is called when a type is generated,
+// types found in the cache are not processed again. The hook is not a part of a key of the cache.
+func WithFieldHook(fn func(structType reflect.Type, fieldIndex int, oldTag, newTag reflect.StructTag)) Option {
+	hook := fieldHook(fn)
+	return func(o *Options) { o.fieldHook = &hook }
+}
+
+// WithoutCache bypasses the cache of generated types, see Options.NoCache.
+func WithoutCache() Option {
+	return func(o *Options) { o.NoCache = true }
+}
+
+// WithStripMethods removes methods promoted from embedded fields, see Options.StripMethods.
+func WithStripMethods() Option {
+	return func(o *Options) { o.StripMethods = true }
+}
+
+func newOptions(opts []Option) Options {
+	if len(opts) == 0 {
+		// the options don't escape to the heap, see BenchmarkConvert
+		return Options{}
+	}
+	o := new(Options)
+	for _, opt := range opts {
+		opt(o)
+	}
+	return *o
+}
+
+// ConvertWith converts p in the same way as Convert does, but respects the options.
+// Options are applied in order. Convert and ConvertAny are ConvertWith without options
+// and with WithAny respectively.
+func ConvertWith(p interface{}, maker TagMaker, opts ...Option) interface{} {
+	return convert(p, maker, newOptions(opts))
+}
+
+// opaqueList is an interned list of types, so the options holding it stay comparable.
+// The same types added in a different order make a different list, it affects
+// the cache only.
+type opaqueList struct {
+	parent *opaqueList
+	t      reflect.Type
+}
+
+var opaqueLists = struct {
+	sync.Mutex
+	m map[opaqueList]*opaqueList
+}{
+	m: make(map[opaqueList]*opaqueList),
+}
+
+func (l *opaqueList) add(t reflect.Type) *opaqueList {
+	if l.contains(t) {
+		return l
+	}
+	key := opaqueList{l, t}
+	opaqueLists.Lock()
+	defer opaqueLists.Unlock()
+	res, ok := opaqueLists.m[key]
+	if !ok {
+		res = &key
+		opaqueLists.m[key] = res
+	}
+	return res
+}
+
+func (l *opaqueList) contains(t reflect.Type) bool {
+	for ; l != nil; l = l.parent {
+		if l.t == t {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldList is an interned list of names of fields, see opaqueList.
+type fieldList struct {
+	parent *fieldList
+	name   string
+}
+
+var fieldLists = struct {
+	sync.Mutex
+	m map[fieldList]*fieldList
+}{
+	m: make(map[fieldList]*fieldList),
+}
+
+func (l *fieldList) add(name string) *fieldList {
+	if l.contains(name) {
+		return l
+	}
+	key := fieldList{l, name}
+	fieldLists.Lock()
+	defer fieldLists.Unlock()
+	res, ok := fieldLists.m[key]
+	if !ok {
+		res = &key
+		fieldLists.m[key] = res
+	}
+	return res
+}
+
+func (l *fieldList) contains(name string) bool {
+	for ; l != nil; l = l.parent {
+		if l.name == name {
+			return true
+		}
+	}
+	return false
+}
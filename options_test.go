@@ -0,0 +1,429 @@
+package retag
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+type SixFields struct {
+	A, B, C, D, E, F int
+}
+
+func TestOptions_MaxFields(test *testing.T) {
+	wide := wideStructType(10)
+	opts := Options{MaxFields: 5}
+	_, err := opts.Convert(reflect.New(wide).Interface(), OmitEmpty("json"))
+	e, ok := err.(*Error)
+	if !ok || e.Type != wide || !strings.Contains(e.Msg, "has 10 fields, more than the limit 5") {
+		test.Errorf("Expect error about the number of fields of %s but got %v", wide, err)
+	}
+
+	nested := new(struct{ Inner *SixFields })
+	if _, err := opts.Convert(nested, OmitEmpty("json")); err == nil {
+		test.Error("Expect error for a nested structure")
+	}
+	if _, err := (Options{MaxFields: 6}).Convert(nested, OmitEmpty("json")); err != nil {
+		test.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := (Options{}).Convert(nested, OmitEmpty("json")); err != nil {
+		test.Errorf("Unexpected error: %v", err)
+	}
+}
+
+type testLogger []string
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	*l = append(*l, fmt.Sprintf(format, v...))
+}
+
+func TestOptions_Logger(test *testing.T) {
+	type Logged struct {
+		Omit  int
+		Xport int
+	}
+	logger := new(testLogger)
+	opts := Options{Logger: logger}
+	for i := 0; i < 2; i++ {
+		if _, err := opts.Convert(new(Logged), maker{}); err != nil {
+			test.Fatal(err)
+		}
+	}
+	expected := []string{
+		"retag: cache miss for retag.Logged",
+		"retag: tag of field Omit of retag.Logged changed from `` to `json:\"-\"`",
+		"retag: generated type for retag.Logged",
+		"retag: cache hit for retag.Logged",
+	}
+	// the cache state of int depends on other tests
+	var lines []string
+	for _, line := range *logger {
+		if strings.Contains(line, "Logged") {
+			lines = append(lines, line)
+		}
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		test.Errorf("Expect log\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(*logger, "\n"))
+	}
+}
+
+type elemInner struct {
+	Name string
+}
+
+func TestOptions_ElemMaker(test *testing.T) {
+	type Outer struct {
+		Direct elemInner
+		List   []elemInner
+		Array  [1]*elemInner
+	}
+	opts := Options{ElemMaker: Snaker("xml")}
+	res, err := opts.Convert(new(Outer), Snaker("json"))
+	if err != nil {
+		test.Fatal(err)
+	}
+	t := reflect.TypeOf(res).Elem()
+	cases := []struct {
+		t   reflect.Type
+		tag reflect.StructTag
+	}{
+		{t, `json:"direct"`},
+		{t.Field(0).Type, `json:"name"`},
+		{t.Field(1).Type.Elem(), `xml:"name"`},
+		{t.Field(2).Type.Elem().Elem(), `xml:"name"`},
+	}
+	for _, c := range cases {
+		if tag := c.t.Field(0).Tag; tag != c.tag {
+			test.Errorf("Expect `%s` but got `%s` for %s", c.tag, tag, c.t)
+		}
+	}
+}
+
+type MethodHolder struct {
+	Xinner int
+}
+
+func (MethodHolder) Hello() string { return "hello" }
+
+type methodsStruct struct {
+	Xport int
+	MethodHolder
+	Ptr *MethodHolder
+	time.Duration
+}
+
+func TestStripMethods(test *testing.T) {
+	p := &methodsStruct{Xport: 1, MethodHolder: MethodHolder{Xinner: 2}}
+	test.Run("Default", func(test *testing.T) {
+		// reflect.StructOf doesn't support an embedded type with methods after the first field
+		defer shouldPanic(test)
+		Convert(p, maker{})
+	})
+	res, err := Options{StripMethods: true}.Convert(p, maker{})
+	if err != nil {
+		test.Fatal(err)
+	}
+	v := reflect.ValueOf(res).Elem()
+	if n := reflect.PointerTo(v.Type()).NumMethod(); n != 0 {
+		test.Errorf("Expect no methods but got %d", n)
+	}
+	if x := v.FieldByName("Xinner"); !x.IsValid() || x.Int() != 2 {
+		test.Errorf("Expect the promoted field Xinner=2 but got %v", x)
+	}
+	if f, _ := v.Type().FieldByName("Duration"); f.Anonymous {
+		test.Error("Expect the embedded Duration to become an ordinary field")
+	}
+	if f, _ := v.Type().FieldByName("Ptr"); f.Type != reflect.TypeOf(p.Ptr) {
+		test.Errorf("Unexpected type of an ordinary field %s", f.Type)
+	}
+}
+
+func TestConvertWith(test *testing.T) {
+	test.Run("Any", func(test *testing.T) {
+		(&MapTestCase{Result: `{"Xport":1}`}).checkResult(ConvertWith(&FlatIFaceStruct{Xport: 1}, maker{}, WithAny()), test)
+		defer shouldPanic(test)
+		ConvertWith(&FlatIFaceStruct{}, maker{})
+	})
+	test.Run("OpaqueTypes", func(test *testing.T) {
+		p := &Struct{Xport1: 1, Xport2: FlatStruct{Omit: 2, Xport: 3}}
+		res := ConvertWith(p, maker{}, WithOpaqueTypes(reflect.TypeOf(FlatStruct{})))
+		(&MapTestCase{Result: `{"Xport1":1,"Xport2":{"Omit":2,"Xport":3}}`}).checkResult(res, test)
+		(&MapTestCase{Result: `{"Xport1":1,"Xport2":{"Xport":3}}`}).checkResult(Convert(p, maker{}), test)
+	})
+	test.Run("WithoutCache", func(test *testing.T) {
+		type uncached struct{ Omit, Xport int }
+		n := CacheLen()
+		(&MapTestCase{Result: `{"Xport":2}`}).checkResult(ConvertWith(&uncached{1, 2}, maker{}, WithoutCache()), test)
+		if CacheLen() != n {
+			test.Errorf("Expect the cache of %d entries but got %d", n, CacheLen())
+		}
+	})
+	test.Run("WithoutCacheCyclic", func(test *testing.T) {
+		type node struct {
+			Omit  int
+			Xnext *node
+			Xkids []node
+		}
+		n, stats := CacheLen(), CacheStats()
+		res := ConvertWith(&node{Xnext: &node{}}, maker{}, WithoutCache())
+		(&MapTestCase{Result: `{"Xnext":{"Omit":0,"Xnext":null,"Xkids":null},"Xkids":null}`}).checkResult(res, test)
+		if CacheLen() != n || CacheStats().Misses != stats.Misses {
+			test.Error("Expect the cache not to be used")
+		}
+	})
+}
+
+func TestMaxDepth(test *testing.T) {
+	type leaf struct{ Omit, Xport int }
+	p := &struct{ Xleaves []*leaf }{}
+	(&MapTestCase{Result: `{"Xleaves":null}`}).checkResult(ConvertWith(p, maker{}, WithMaxDepth(4)), test)
+	_, err := Options{MaxDepth: 3}.Convert(p, maker{})
+	if err == nil || !strings.Contains(err.Error(), "exceeds the limit 3") {
+		test.Errorf("Expect an error about the depth but got %v", err)
+	}
+}
+
+func TestMaxDepthCached(test *testing.T) {
+	type leaf struct{ Omit, Xport int }
+	type branch struct{ Xleaf *leaf }
+	opts := Options{MaxDepth: 3}
+	if _, err := opts.Convert(&branch{}, maker{}); err != nil {
+		test.Fatal(err)
+	}
+	// the cached branch still counts
+	if _, err := opts.Convert(&struct{ Xbranch branch }{}, maker{}); err == nil {
+		test.Error("Expect an error about the depth of a cached type")
+	}
+}
+
+type privateStruct struct {
+	Omit   int
+	Xport  int
+	secret string
+}
+
+func TestUnexportedStrategy(test *testing.T) {
+	p := &privateStruct{Omit: 1, Xport: 2, secret: "s"}
+	test.Run("Panic", func(test *testing.T) {
+		if _, err := (Options{Unexported: UnexportedPanic}).Convert(p, maker{}); err == nil {
+			test.Error("Expect an error")
+		}
+	})
+	test.Run("Skip", func(test *testing.T) {
+		res := ConvertWith(p, maker{}, WithUnexportedStrategy(UnexportedSkip))
+		if res != interface{}(p) {
+			test.Errorf("Expect the source value but got %T", res)
+		}
+	})
+	test.Run("Keep", func(test *testing.T) {
+		res := ConvertWith(p, maker{}, WithUnexportedStrategy(UnexportedKeep))
+		(&MapTestCase{Result: `{"Xport":2}`}).checkResult(res, test)
+		field, ok := reflect.TypeOf(res).Elem().FieldByName("secret")
+		if !ok || field.Offset != unsafe.Offsetof(p.secret) {
+			test.Errorf("Expect the unexported field to be kept, got %+v", field)
+		}
+	})
+}
+
+func TestPassthroughUnsupported(test *testing.T) {
+	type withChan struct {
+		Omit   int
+		Xport  int
+		Events chan int
+		Hook   func()
+		Raw    unsafe.Pointer
+	}
+	p := &withChan{Xport: 1, Events: make(chan int)}
+	if _, err := (Options{}).Convert(p, maker{}); err == nil {
+		test.Error("Expect an error for unsupported types by default")
+	}
+	res := ConvertWith(p, maker{}, WithPassthroughUnsupported())
+	(&MapTestCase{Result: `{"Xport":1}`}).checkResult(res, test)
+	if events := reflect.ValueOf(res).Elem().FieldByName("Events").Interface(); events != interface{}(p.Events) {
+		test.Error("Expect the channel to be kept")
+	}
+}
+
+type malformedMaker struct{}
+
+func (malformedMaker) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	if t.Field(fieldIndex).Name == "Xport" {
+		return `json:xport`
+	}
+	return `json:"omit"`
+}
+
+func TestValidateTags(test *testing.T) {
+	if _, err := (Options{}).Convert(new(FlatStruct), malformedMaker{}); err != nil {
+		test.Errorf("Expect no validation by default but got %v", err)
+	}
+	_, err := Options{ValidateTags: true}.Convert(new(FlatStruct), malformedMaker{})
+	expected := "the maker made malformed tag `json:xport` for the field 1 (Xport) of retag.FlatStruct"
+	if err == nil || err.Error() != expected {
+		test.Errorf("Expect the error %q but got %v", expected, err)
+	}
+	(&MapTestCase{Result: `{"omit":0,"xport":0}`}).checkResult(ConvertWith(new(FlatStruct), Snaker("json"), WithValidateTags()), test)
+
+	// the malformed tag can't be written in a literal, vet rejects it
+	source := reflect.StructOf([]reflect.StructField{
+		{Name: "Bad", Type: reflect.TypeOf(0), Tag: `json:bad`},
+		{Name: "Plain", Type: reflect.TypeOf(0)},
+	})
+	if _, err := (Options{ValidateTags: true}).Convert(reflect.New(source).Interface(), validateMaker{}); err != nil {
+		test.Errorf("Expect no validation of kept tags but got %v", err)
+	}
+	if _, err := newOptions([]Option{WithValidateTags(), WithFields("Plain")}).Convert(reflect.New(source).Interface(), omitEmptier{}); err != nil {
+		test.Errorf("Expect no validation of tags of skipped fields but got %v", err)
+	}
+	_, err = Options{ValidateTags: true}.Convert(reflect.New(source).Interface(), omitEmptier{})
+	if e, ok := err.(*Error); !ok || !strings.HasPrefix(e.Msg, "the source type") || !strings.Contains(e.Msg, "`json:bad`") {
+		test.Errorf("Expect the error of the source type but got %v", err)
+	}
+}
+
+func TestInterfaceCopy(test *testing.T) {
+	p := &FlatIFaceStruct{Xport: 1, Data: &FlatStruct{Xport: 2}}
+	res := ConvertWith(p, maker{}, WithInterfaceCopy())
+	(&MapTestCase{Result: `{"Xport":1}`}).checkResult(res, test)
+	v := reflect.ValueOf(res).Elem()
+	if v.Field(1).Interface() != p.Data {
+		test.Error("Expect the interface value to be copied as is")
+	}
+	p.Xport = 3
+	if v.Field(0).Int() != 1 {
+		test.Error("Expect the converted value not to share memory with the source")
+	}
+	// types without interfaces are still aliased
+	flat := &FlatStruct{}
+	res = ConvertWith(flat, maker{}, WithInterfaceCopy())
+	if reflect.ValueOf(res).Pointer() != reflect.ValueOf(flat).Pointer() {
+		test.Error("Expect a type without interfaces to share memory with the source")
+	}
+}
+
+func TestFieldHook(test *testing.T) {
+	type hooked struct {
+		Omit  int `json:"omit"`
+		Xport int
+	}
+	var calls []string
+	hook := func(t reflect.Type, i int, oldTag, newTag reflect.StructTag) {
+		calls = append(calls, fmt.Sprintf("%s `%s` `%s`", t.Field(i).Name, oldTag, newTag))
+	}
+	ConvertWith(new(hooked), maker{}, WithFieldHook(hook), WithoutCache())
+	expected := []string{"Omit `json:\"omit\"` `json:\"-\"`", "Xport `` ``"}
+	if !reflect.DeepEqual(calls, expected) {
+		test.Errorf("Expect calls %q but got %q", expected, calls)
+	}
+	// the hook doesn't affect the cache key
+	if reflect.TypeOf(ConvertWith(new(hooked), maker{}, WithFieldHook(hook))) != reflect.TypeOf(Convert(new(hooked), maker{})) {
+		test.Error("Expect the same type with and without the hook")
+	}
+}
+
+func TestTypedEntryPointsWithAny(test *testing.T) {
+	p := &FlatIFaceStruct{Xport: 1}
+	expected := `{"Xport":1}`
+	entryPoints := map[string]func(opts ...Option) interface{}{
+		"ConvertTo": func(opts ...Option) interface{} { return ConvertTo(p, maker{}, opts...) },
+		"ConvertValue": func(opts ...Option) interface{} {
+			return ConvertValue(reflect.ValueOf(p), maker{}, opts...).Interface()
+		},
+		"ConvertType": func(opts ...Option) interface{} {
+			return reflect.NewAt(ConvertType(reflect.TypeOf(*p), maker{}, opts...), unsafe.Pointer(p)).Interface()
+		},
+		"ConvertWithMapping": func(opts ...Option) interface{} {
+			res, _ := ConvertWithMapping(p, maker{}, opts...)
+			return res
+		},
+	}
+	for name, convert := range entryPoints {
+		test.Run(name, func(test *testing.T) {
+			(&MapTestCase{Result: expected}).checkResult(convert(WithAny()), test)
+			defer shouldPanic(test)
+			convert()
+		})
+	}
+}
+
+func TestSizePadding(test *testing.T) {
+	test.Run("TrailingZeroSizeField", func(test *testing.T) {
+		// simulates reflect.StructOf of go1.7
+		defer func(fixed bool) { trailingZeroSizeFieldBugWasFixed = fixed }(trailingZeroSizeFieldBugWasFixed)
+		trailingZeroSizeFieldBugWasFixed = false
+		type padded struct {
+			Xport int64
+			Xvoid struct{}
+		}
+		if _, err := (Options{}).Convert(new(padded), Snaker("json")); err == nil {
+			test.Error("Expect an error without the padding")
+		}
+		res := ConvertWith(&padded{Xport: 1}, Snaker("json"), WithSizePadding())
+		(&MapTestCase{Result: `{"xport":1,"xvoid":{}}`}).checkResult(res, test)
+		if size := reflect.TypeOf(res).Elem().Size(); size != reflect.TypeOf(padded{}).Size() {
+			test.Errorf("Expect the size %d but got %d", reflect.TypeOf(padded{}).Size(), size)
+		}
+	})
+	test.Run("PaddingField", func(test *testing.T) {
+		source := reflect.TypeOf(struct {
+			X int64
+			Y struct{}
+		}{})
+		result := reflect.StructOf([]reflect.StructField{source.Field(0), source.Field(1), paddingField(source.Size() - source.Field(1).Offset)})
+		compareStructTypes(source, result)
+		(&MapTestCase{Result: `{"X":0,"Y":{}}`}).checkResult(reflect.New(result).Interface(), test)
+	})
+}
+
+func TestWithFields(test *testing.T) {
+	type selected struct {
+		Omit   int `json:"o"`
+		Xport  int
+		Xinner FlatStruct
+	}
+	p := &selected{1, 2, FlatStruct{Omit: 3, Xport: 4}}
+	res := ConvertWith(p, Snaker("json"), WithFields("Xport"))
+	(&MapTestCase{Result: `{"o":1,"xport":2,"Xinner":{"Omit":3,"xport":4}}`}).checkResult(res, test)
+
+	unselected := &struct{ Omit, Xport int }{}
+	if res := ConvertWith(unselected, Snaker("json"), WithFields("Other")); reflect.TypeOf(res) != reflect.TypeOf(unselected) {
+		test.Errorf("Expect the type %T unchanged but got %T", unselected, res)
+	}
+}
+
+func TestOptionsAffectNothing(test *testing.T) {
+	values := []interface{}{maker{}, log.New(io.Discard, "", 0), context.Background()}
+	n := reflect.TypeOf(Options{}).NumField()
+	for i := 0; i < n; i++ {
+		var o Options
+		v := reflect.ValueOf(&o).Elem().Field(i)
+		f := reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr())).Elem()
+		switch f.Kind() {
+		case reflect.Bool:
+			f.SetBool(true)
+		case reflect.Int:
+			f.SetInt(1)
+		case reflect.Pointer:
+			f.Set(reflect.New(f.Type().Elem()))
+		case reflect.Interface:
+			for _, value := range values {
+				if reflect.TypeOf(value).Implements(f.Type()) {
+					f.Set(reflect.ValueOf(value))
+					break
+				}
+			}
+		}
+		if f.IsZero() {
+			test.Fatalf("The test doesn't know how to set the field %s", reflect.TypeOf(o).Field(i).Name)
+		}
+		if o.affectNothing() != (o.keyed() == Options{}) {
+			test.Errorf("affectNothing doesn't check the field %s", reflect.TypeOf(o).Field(i).Name)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package retag
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// A ContainerKind describes how a structure is reached from its parent on a FieldPath.
+type ContainerKind int
+
+const (
+	// ContainerField means the value is a field of a structure.
+	ContainerField ContainerKind = iota
+	// ContainerPointer means the value is pointed by a pointer.
+	ContainerPointer
+	// ContainerSlice means the value is an element of a slice.
+	ContainerSlice
+	// ContainerArray means the value is an element of an array.
+	ContainerArray
+	// ContainerMapKey means the value is a key of a map.
+	ContainerMapKey
+	// ContainerMapValue means the value is a value of a map.
+	ContainerMapValue
+)
+
+var containerKindNames = [...]string{
+	ContainerField:    "field",
+	ContainerPointer:  "pointer",
+	ContainerSlice:    "slice",
+	ContainerArray:    "array",
+	ContainerMapKey:   "map key",
+	ContainerMapValue: "map value",
+}
+
+func (k ContainerKind) String() string {
+	if k < 0 || int(k) >= len(containerKindNames) {
+		return "unknown"
+	}
+	return containerKindNames[k]
+}
+
+// A PathFrame is a step on the way from the converted structure to a nested one.
+type PathFrame struct {
+	Kind ContainerKind
+	// Struct and Field describe the field of the enclosing structure for ContainerField frames.
+	Struct reflect.Type
+	Field  reflect.StructField
+}
+
+// A FieldPath is a chain of frames from the converted structure (the root) to a nested structure.
+// E.g. the path to Inner in struct{ Items []*Inner } is the field Items, a slice and a pointer.
+// The path of the root is empty.
+type FieldPath []PathFrame
+
+// Fields returns the chain of enclosing fields from the root to the structure,
+// frames of pointers, slices, arrays and maps are skipped. E.g. it lets to prefix
+// a name with the names of the parent fields.
+func (p FieldPath) Fields() []reflect.StructField {
+	var fields []reflect.StructField
+	for _, frame := range p {
+		if frame.Kind == ContainerField {
+			fields = append(fields, frame.Field)
+		}
+	}
+	return fields
+}
+
+// String formats the path like Orders[].Handler: names of fields are joined by dots,
+// elements of slices and arrays and values of maps are marked by [], keys of maps by [key];
+// pointers are omitted.
+func (p FieldPath) String() string {
+	var b strings.Builder
+	for _, frame := range p {
+		switch frame.Kind {
+		case ContainerField:
+			if b.Len() > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(frame.Field.Name)
+		case ContainerSlice, ContainerArray, ContainerMapValue:
+			b.WriteString("[]")
+		case ContainerMapKey:
+			b.WriteString("[key]")
+		}
+	}
+	return b.String()
+}
+
+// A PathAwareTagMaker is a TagMaker which makes tags depending on the place of a structure
+// in the hierarchy of the converted type. The Convert function calls MakeTagPath
+// instead of MakeTag (or MakeResolvedTag) for makers implementing the interface.
+//
+// Types generated for the same structure and different paths are cached separately.
+type PathAwareTagMaker interface {
+	TagMaker
+	// MakeTagPath makes tag for the field of the structure reached by the path.
+	// The same rules as for MakeTag are applied.
+	MakeTagPath(structureType reflect.Type, fieldIndex int, path FieldPath) reflect.StructTag
+}
+
+// pathNode is an interned frame of a path. Interned nodes let to use a path as a part
+// of a key of the cache: equal paths are represented by the same node.
+type pathNode struct {
+	parent *pathNode
+	frame  PathFrame
+}
+
+type pathNodeKey struct {
+	parent *pathNode
+	kind   ContainerKind
+	st     reflect.Type
+	index  int
+}
+
+var pathNodes = struct {
+	sync.Mutex
+	m map[pathNodeKey]*pathNode
+}{
+	m: make(map[pathNodeKey]*pathNode),
+}
+
+func (n *pathNode) child(kind ContainerKind, structType reflect.Type, fieldIndex int) *pathNode {
+	key := pathNodeKey{n, kind, structType, fieldIndex}
+	pathNodes.Lock()
+	defer pathNodes.Unlock()
+	child, ok := pathNodes.m[key]
+	if !ok {
+		child = &pathNode{parent: n, frame: PathFrame{Kind: kind}}
+		if kind == ContainerField {
+			child.frame.Struct = structType
+			child.frame.Field = structType.Field(fieldIndex)
+		}
+		pathNodes.m[key] = child
+	}
+	return child
+}
+
+func (n *pathNode) path() FieldPath {
+	var path FieldPath
+	for ; n != nil; n = n.parent {
+		path = append(path, n.frame)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
@@ -0,0 +1,111 @@
+package retag
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// sliceOmitter adds omitempty to json tags of structures which are elements of slices.
+type sliceOmitter struct{}
+
+func (sliceOmitter) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	return t.Field(fieldIndex).Tag
+}
+
+func (sliceOmitter) MakeTagPath(t reflect.Type, fieldIndex int, path FieldPath) reflect.StructTag {
+	name := t.Field(fieldIndex).Name
+	if n := len(path); n > 0 && path[n-1].Kind == ContainerSlice {
+		return reflect.StructTag(`json:"` + name + `,omitempty"`)
+	}
+	return reflect.StructTag(`json:"` + name + `"`)
+}
+
+type pathInner struct {
+	A int
+}
+
+type pathOuter struct {
+	Direct pathInner
+	Items  []pathInner
+	Ptrs   map[string][]*pathInner
+}
+
+func TestPathAwareTagMaker(test *testing.T) {
+	p := &pathOuter{
+		Items: []pathInner{{}},
+		Ptrs:  map[string][]*pathInner{"x": {{}}},
+	}
+	b, err := json.Marshal(Convert(p, sliceOmitter{}))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if expected := `{"Direct":{"A":0},"Items":[{}],"Ptrs":{"x":[{"A":0}]}}`; string(b) != expected {
+		test.Errorf("Expect `%s` but got `%s`", expected, b)
+	}
+}
+
+// pathRecorder records paths passed to the maker.
+type pathRecorder struct {
+	paths *[]FieldPath
+}
+
+func (r pathRecorder) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	return t.Field(fieldIndex).Tag
+}
+
+func (r pathRecorder) MakeTagPath(t reflect.Type, fieldIndex int, path FieldPath) reflect.StructTag {
+	if t == reflect.TypeOf(pathInner{}) {
+		*r.paths = append(*r.paths, path)
+	}
+	return t.Field(fieldIndex).Tag
+}
+
+func TestFieldPath(test *testing.T) {
+	var paths []FieldPath
+	Convert(new(pathOuter), pathRecorder{&paths})
+	outer := reflect.TypeOf(pathOuter{})
+	field := func(i int) PathFrame {
+		return PathFrame{Kind: ContainerField, Struct: outer, Field: outer.Field(i)}
+	}
+	expected := []FieldPath{
+		{field(0)},
+		{field(1), {Kind: ContainerSlice}},
+		{field(2), {Kind: ContainerMapValue}, {Kind: ContainerSlice}, {Kind: ContainerPointer}},
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		test.Errorf("Expect paths %v but got %v", expected, paths)
+	}
+}
+
+// prefixer prefixes json names with the names of the enclosing fields.
+type prefixer struct{}
+
+func (prefixer) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	return t.Field(fieldIndex).Tag
+}
+
+func (prefixer) MakeTagPath(t reflect.Type, fieldIndex int, path FieldPath) reflect.StructTag {
+	name := ""
+	for _, field := range path.Fields() {
+		name += field.Name + "."
+	}
+	return reflect.StructTag(`json:"` + name + t.Field(fieldIndex).Name + `"`)
+}
+
+func TestFieldPathFields(test *testing.T) {
+	type outer struct {
+		Outer struct {
+			Ptrs map[string][]*pathInner
+		}
+	}
+	p := &outer{}
+	p.Outer.Ptrs = map[string][]*pathInner{"x": {{A: 1}}}
+	b, err := json.Marshal(Convert(p, prefixer{}))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if expected := `{"Outer":{"Outer.Ptrs":{"x":[{"Outer.Ptrs.A":1}]}}}`; string(b) != expected {
+		test.Errorf("Expect `%s` but got `%s`", expected, b)
+	}
+}
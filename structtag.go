@@ -0,0 +1,92 @@
+package retag
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A TagPair is a key and an unquoted value of a section of a tag, e.g. json and "name,omitempty"
+// for the section json:"name,omitempty".
+type TagPair struct {
+	Key   string
+	Value string
+}
+
+// ErrMalformedTag is returned by ParseStructTag for a tag which doesn't follow
+// the conventional format of reflect.StructTag.
+var ErrMalformedTag = errors.New("malformed tag")
+
+// ParseStructTag splits the tag into sections in their order using the same rules
+// as reflect.StructTag.Lookup does. It lets maker authors to manipulate individual keys
+// of a tag and to serialize it back by SerializeStructTag keeping the order of other keys.
+// ParseStructTag returns ErrMalformedTag if the tag doesn't follow the conventional format.
+func ParseStructTag(tag reflect.StructTag) ([]TagPair, error) {
+	var pairs []TagPair
+	s := string(tag)
+	for {
+		s = strings.TrimLeft(s, " ")
+		if s == "" {
+			return pairs, nil
+		}
+		i := 0
+		for i < len(s) && s[i] > ' ' && s[i] != ':' && s[i] != '"' && s[i] != 0x7f {
+			i++
+		}
+		if i == 0 || i+1 >= len(s) || s[i] != ':' || s[i+1] != '"' {
+			return nil, ErrMalformedTag
+		}
+		key := s[:i]
+		s = s[i+1:]
+
+		i = 1
+		for i < len(s) && s[i] != '"' {
+			if s[i] == '\\' {
+				i++
+			}
+			i++
+		}
+		if i >= len(s) {
+			return nil, ErrMalformedTag
+		}
+		value, err := strconv.Unquote(s[:i+1])
+		if err != nil {
+			return nil, ErrMalformedTag
+		}
+		s = s[i+1:]
+		pairs = append(pairs, TagPair{key, value})
+	}
+}
+
+// SerializeStructTag joins the sections into a tag in their order, the sections are separated
+// by a single space and values are quoted. It is the inverse of ParseStructTag
+// up to the whitespace and the quoting of a well-formed tag.
+func SerializeStructTag(pairs []TagPair) reflect.StructTag {
+	var b strings.Builder
+	for i, pair := range pairs {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(pair.Key)
+		b.WriteByte(':')
+		b.WriteString(strconv.Quote(pair.Value))
+	}
+	return reflect.StructTag(b.String())
+}
+
+// setTagValue replaces the value of the key in the tag or appends the section if the key is absent.
+// A malformed tag is kept as is and the section is appended to it.
+func setTagValue(tag reflect.StructTag, key, value string) reflect.StructTag {
+	pairs, err := ParseStructTag(tag)
+	if err != nil {
+		return tag + " " + SerializeStructTag([]TagPair{{key, value}})
+	}
+	for i := range pairs {
+		if pairs[i].Key == key {
+			pairs[i].Value = value
+			return SerializeStructTag(pairs)
+		}
+	}
+	return SerializeStructTag(append(pairs, TagPair{key, value}))
+}
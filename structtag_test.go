@@ -0,0 +1,68 @@
+package retag
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStructTag(test *testing.T) {
+	cases := []struct {
+		tag   reflect.StructTag
+		pairs []TagPair
+		err   bool
+	}{
+		{``, nil, false},
+		{`json:"name"`, []TagPair{{"json", "name"}}, false},
+		{`json:"name,omitempty"  xml:"a b" db:"x\"y"`,
+			[]TagPair{{"json", "name,omitempty"}, {"xml", "a b"}, {"db", `x"y`}}, false},
+		{`json:name`, nil, true},
+		{`json:"name`, nil, true},
+		{`:"name"`, nil, true},
+	}
+	for _, c := range cases {
+		pairs, err := ParseStructTag(c.tag)
+		if (err == ErrMalformedTag) != c.err || !reflect.DeepEqual(pairs, c.pairs) {
+			test.Errorf("Unexpected result %v, %v for tag `%s`", pairs, err, c.tag)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		for _, pair := range pairs {
+			if value, _ := SerializeStructTag(pairs).Lookup(pair.Key); value != pair.Value {
+				test.Errorf("Expect `%s` but got `%s` after formatting of `%s`", pair.Value, value, c.tag)
+			}
+		}
+	}
+}
+
+func TestSerializeStructTag(test *testing.T) {
+	tag := reflect.StructTag(`json:"x" yaml:"y"  validate:"required"`)
+	pairs, err := ParseStructTag(tag)
+	if err != nil {
+		test.Fatal(err)
+	}
+	pairs[1].Value = "z"
+	if result := SerializeStructTag(pairs); result != `json:"x" yaml:"z" validate:"required"` {
+		test.Errorf("Expect the keys in the original order but got `%s`", result)
+	}
+	if result := SerializeStructTag(nil); result != "" {
+		test.Errorf("Expect an empty tag but got `%s`", result)
+	}
+}
+
+func TestSetTagValue(test *testing.T) {
+	cases := []struct {
+		tag, result reflect.StructTag
+	}{
+		{``, `type:"T"`},
+		{`json:"name"`, `json:"name" type:"T"`},
+		{`type:"old" json:"name"`, `type:"T" json:"name"`},
+		{`malformed`, `malformed type:"T"`},
+	}
+	for _, c := range cases {
+		if result := setTagValue(c.tag, "type", "T"); result != c.result {
+			test.Errorf("Expect `%s` but got `%s` for `%s`", c.result, result, c.tag)
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package retag
 
 import (
-	"fmt"
+	"database/sql"
 	"reflect"
-	"runtime"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
 	"unsafe"
 )
 
@@ -20,6 +22,105 @@ type TagMaker interface {
 	MakeTag(structureType reflect.Type, fieldIndex int) reflect.StructTag
 }
 
+// KeepTag can be returned by a TagMaker (by any of its methods) to keep the original tag
+// of a field. It lets a maker to change tags of some fields only without reading and
+// returning the original tags of the other ones. The value is not a valid tag.
+const KeepTag reflect.StructTag = "\x00retag:keep"
+
+// FieldInfo describes a field of a structure for ResolvedTagMaker.
+type FieldInfo struct {
+	// Struct is the source structure type.
+	Struct reflect.Type
+	// Index is the index of the field in the Struct.
+	Index int
+	// Field is the source field.
+	Field reflect.StructField
+	// Type is the resolved type of the field in the generated structure.
+	// It differs from the type of the source field if the type has its own analogue.
+	Type reflect.Type
+	// Layout is the layout of the field in the source structure,
+	// the generated structure has the same layout.
+	Layout FieldLayoutInfo
+}
+
+// FieldLayoutInfo describes the place of a field in memory.
+type FieldLayoutInfo struct {
+	// Offset is the offset of the field within the structure, in bytes.
+	Offset uintptr
+	// Size is the size of the field, in bytes.
+	Size uintptr
+}
+
+func newFieldInfo(structType reflect.Type, fieldIndex int, resolved reflect.Type) FieldInfo {
+	field := structType.Field(fieldIndex)
+	return FieldInfo{
+		Struct: structType,
+		Index:  fieldIndex,
+		Field:  field,
+		Type:   resolved,
+		Layout: FieldLayoutInfo{Offset: field.Offset, Size: field.Type.Size()},
+	}
+}
+
+// A ResolvedTagMaker is a TagMaker which needs additional information about a field to make its tag,
+// e.g. the resolved type of the field. The Convert function calls MakeResolvedTag instead
+// of MakeTag for makers implementing the interface.
+type ResolvedTagMaker interface {
+	TagMaker
+	// MakeResolvedTag makes tag for the field. The same rules as for MakeTag are applied.
+	MakeResolvedTag(field FieldInfo) reflect.StructTag
+}
+
+// A TagTransformer is a TagMaker which transforms the original tag of a field
+// (e.g. augments it) rather than makes a new one. The Convert function calls TransformTag
+// instead of MakeTag for makers implementing the interface.
+//
+// There is no way to have the both methods of the same name, so the method is called TransformTag.
+type TagTransformer interface {
+	TagMaker
+	// TransformTag makes tag for the field the fieldIndex in the structureType
+	// on base of its original tag oldTag. The same rules as for MakeTag are applied.
+	TransformTag(structureType reflect.Type, fieldIndex int, oldTag reflect.StructTag) reflect.StructTag
+}
+
+// A FieldOpaqueDecider is a TagMaker which decides for every field whether its type is kept
+// unchanged like an opaque type (see RegisterOpaqueType), e.g. to stop at types of another package.
+// The tag of the field is still made by the maker. The same rules as for MakeTag are applied.
+type FieldOpaqueDecider interface {
+	TagMaker
+	// ShouldTreatAsOpaque reports whether the type of the field the fieldIndex
+	// in the structureType is kept unchanged.
+	ShouldTreatAsOpaque(structureType reflect.Type, fieldIndex int) bool
+}
+
+// An IdentifiedTagMaker is a TagMaker which is identified in the cache of generated types
+// by the result of Identity instead of its own value. Makers of the same type with equal identities
+// share cached types, so makers built per call (e.g. from a configuration) still hit the cache,
+// and the maker itself doesn't have to be comparable. Makers with equal identities must make
+// the same tags. The identity must be comparable.
+type IdentifiedTagMaker interface {
+	TagMaker
+	// Identity returns the identity of the maker. It should be cheap, it is called for every conversion.
+	Identity() interface{}
+}
+
+// A StructTagMaker is a TagMaker which annotates structure types themselves: Go has no tags
+// of types, so the annotation is a synthetic exported field of type struct{} appended to
+// the generated structure with the name and the tag returned by MakeStructTag, e.g. for libraries
+// which read a tag of a sentinel field. The same rules as for MakeTag are applied.
+//
+// The marker field changes the layout of the structure (a final zero-size field is padded),
+// so a value of the source type can't be reinterpreted as a value of such a type.
+// The marker fields are added by DeepConvert only, which copies values; the other
+// functions ignore MakeStructTag.
+type StructTagMaker interface {
+	TagMaker
+	// MakeStructTag returns the name and the tag of the marker field of the structureType,
+	// ok is false if the structure doesn't need the field. The name must be exported
+	// and differ from the names of fields of the structure.
+	MakeStructTag(structureType reflect.Type) (fieldName string, tag reflect.StructTag, ok bool)
+}
+
 // Convert converts the given interface p, to a runtime-generated type.
 // The type is generated on base of source type by the next rules:
 //   - Analogous type with custom tags is generated for structures.
@@ -27,20 +128,39 @@ type TagMaker interface {
 //   - Type is replaced with a generated one if it has field, element or key of type
 //     which should be replaced with its own analogue or if it is structure.
 //   - A type of private fields of structures is not modified.
+//   - Opaque types (see RegisterOpaqueType) are not modified.
+//   - A named type (e.g. type Tags map[string]Inner) is kept as is if its key and element types
+//     are not replaced. Otherwise the replacement is an unnamed type (map[string]T where T is the analogue
+//     of Inner for the example), because reflect package can't create named types: the layout is the same,
+//     but the name and methods of the named type are lost.
 //
-// Convert panics if argument p has a type different from a pointer to structure.
-// The maker's underlying type should be comparable. In different case panic occurs.
+// Convert panics if argument p has a type different from a pointer to structure. A pointer to slice,
+// array or map (e.g. *[]T or *map[string]T) is accepted too, its element and key types are converted
+// by the rules above and the result is a pointer to the generated slice, array or map type.
+// A typed nil pointer (e.g. (*T)(nil)) is converted to a nil pointer of the generated type,
+// but an untyped nil is an error.
+// The maker's underlying type should be comparable (unless it is IdentifiedTagMaker). In different case panic occurs.
+//
+// Convert panics if the maker changes tags of a structure used as a map key which has adjacent fields
+// of integers, booleans or pointers (e.g. struct{ A, B int }): the compiler hashes such fields at once,
+// but a generated structure is hashed field by field, so the entries of the map couldn't be found.
 //
 // Convert panics if the maker attempts to change a field tag of a structure with unexported fields
 // because reflect package doesn't support creation of a structure type with private fields.
+// Blank fields (named "_") are not considered as unexported ones.
+// See Options.Unexported for other ways to handle such structures.
 //
 // Convert puts generated types in a cache by a key (source type + maker) to speed up
 // handling of types. See notes in description of TagMaker interface to avoid
 // the tricky situation with the cache.
 //
 // Convert doesn't support cyclic references because reflect package doesn't support generation of
-// types with cyclic references. Passing cyclic structures to Convert will result in an infinite
-// recursion.
+// types with cyclic references: reflect.StructOf requires complete types of fields and there is
+// no way to create a placeholder type and patch it later. A field which refers back to a structure
+// (or a named pointer, slice, array or map type, e.g. type Tree map[string][]Tree)
+// being converted keeps its original type, so tags of the nested occurrences of the structure
+// are not changed (e.g. for type Node struct { Next *Node } the generated type has the field
+// Next of type *Node). Use IsCyclic to detect such types beforehand and to choose another way of encoding.
 //
 // Convert doesn't support any interfaces, functions, chan and unsafe pointers.
 // Interfaces is not supported because they requires memory-copy operations in most cases.
@@ -49,138 +169,923 @@ type TagMaker interface {
 // Convert doesn't reconstruct methods for a structure type until go1.9
 // because it is not supported by reflect package.
 // Convert can raise a panic since go1.9 if a structure derivative type has too much methods (more than 32).
+// Newer versions of reflect package have no limit of the number of methods, but panic if an embedded
+// type with methods is not the first field of a structure; use Options.StripMethods to avoid it.
+//
+// The panics caused by a type which can't be converted have a value of type *Error,
+// so Convert is the Must-form of ConvertE.
 //
-// BUG(yar): Convert panics on structure with a final zero-size field in go1.7.
-// It is fixed in go1.8 (see github.com/golang/go/issues/18016).
+// BUG(yar): Convert panics on structure with a final zero-size field in go1.7
+// if the maker changes its tags. It is fixed in go1.8 (see github.com/golang/go/issues/18016).
 func Convert(p interface{}, maker TagMaker) interface{} {
-	return convert(p, maker, false)
+	return ConvertWith(p, maker)
+}
+
+// ConvertE is the same as Convert except it returns an error of type *Error instead of panic
+// if the type of p can't be converted.
+func ConvertE(p interface{}, maker TagMaker) (interface{}, error) {
+	return Options{}.Convert(p, maker)
+}
+
+// ConvertTo is the same as Convert except p is statically typed as a pointer, so passing
+// a value instead of a pointer is caught by the compiler. The result still has to be
+// of interface type: the generated type has different tags, so it is a different type than T
+// and a *T can't carry them. The result shares memory with p. The options are applied
+// as ConvertWith does.
+func ConvertTo[T any](p *T, maker TagMaker, opts ...Option) interface{} {
+	return convert(p, maker, newOptions(opts))
 }
 
 // ConvertAny is basically the same as Convert except it doesn't panic in case if struct field has empty interface type,
 // it's just left unchanged
 func ConvertAny(p interface{}, maker TagMaker) interface{} {
-	return convert(p, maker, true)
+	return convert(p, maker, Options{Any: true})
 }
 
-func convert(p interface{}, maker TagMaker, any bool) interface{} {
-	strPtrVal := reflect.ValueOf(p)
-	// TODO(yar): check type (pointer to the structure)
-	res := getType(strPtrVal.Type().Elem(), maker, any, map[string]bool{})
-	newPtrVal := reflect.NewAt(res.t, unsafe.Pointer(strPtrVal.Pointer()))
-	return newPtrVal.Interface()
+// ConvertAnyValue converts a value of structure type or a pointer to structure, e.g. a value
+// retrieved from map[string]interface{} or sync.Map. A pointer is converted in the same way
+// as ConvertE does and the result shares memory with the source. A value of structure type
+// held by an interface is not addressable, so it is copied to a new location and the copy is
+// converted; the returned value has the generated structure type (not a pointer).
+//
+// ConvertAnyValue returns an error of type *Error if v has another type or can't be converted.
+func ConvertAnyValue(v interface{}, maker TagMaker) (interface{}, error) {
+	t := reflect.TypeOf(v)
+	switch {
+	case t != nil && t.Kind() == reflect.Pointer && t.Elem().Kind() == reflect.Struct:
+		return ConvertE(v, maker)
+	case t != nil && t.Kind() == reflect.Struct:
+		p := reflect.New(t)
+		p.Elem().Set(reflect.ValueOf(v))
+		res, err := ConvertE(p.Interface(), maker)
+		if err != nil {
+			return nil, err
+		}
+		return reflect.ValueOf(res).Elem().Interface(), nil
+	}
+	return nil, errorf(t, "unable to convert value of type %v, because it is neither a structure nor a pointer to structure", t)
+}
+
+// ConvertValueCopy converts a value of structure type (not a pointer): the value is copied
+// to a new location and the result is a pointer to the copy of the generated type,
+// so it doesn't share memory with the source. It saves a temporary variable
+// for values which are not addressable.
+//
+// ConvertValueCopy panics with *Error if v is not a structure, and in the same cases as Convert.
+func ConvertValueCopy(v interface{}, maker TagMaker) interface{} {
+	t := reflect.TypeOf(v)
+	if t == nil || t.Kind() != reflect.Struct {
+		panic(errorf(t, "unable to convert value of type %v, because it is not a structure", t))
+	}
+	p := reflect.New(t)
+	p.Elem().Set(reflect.ValueOf(v))
+	return convertValue(p, maker, Options{}).Interface()
+}
+
+// ConvertValue is the same as Convert except it takes and returns reflect.Value.
+// The value v must be a pointer (see Convert), the result is a pointer to the generated type
+// which shares memory with v. It lets to avoid wrapping to interface and back for code working
+// with reflection. ConvertValue shares the cache with Convert and panics in the same cases.
+// The options are applied as ConvertWith does.
+func ConvertValue(v reflect.Value, maker TagMaker, opts ...Option) reflect.Value {
+	return convertValue(v, maker, newOptions(opts))
+}
+
+// ConvertType returns the type generated by the maker for the type t without any value,
+// e.g. to register the type in a codec beforehand. The type t can be a structure, slice,
+// array or map type, or a pointer to one of them; the result is the generated type
+// or a pointer to it respectively. ConvertType shares the cache with Convert and
+// panics in the same cases. The options are applied as ConvertWith does.
+func ConvertType(t reflect.Type, maker TagMaker, opts ...Option) reflect.Type {
+	if t == nil {
+		panic(errorf(nil, "unable to convert nil, a type is expected"))
+	}
+	elem := t
+	if t.Kind() == reflect.Pointer {
+		elem = t.Elem()
+	}
+	checkConvertible(elem)
+	res := newConversion(maker, newOptions(opts)).getType(t)
+	return res.t
+}
+
+// ConvertChecked converts p in the same way as Convert does and reports whether the generated
+// type differs from the source one. If the maker changes nothing, p itself is returned and
+// changed is false, so callers can skip further processing of no-op conversions.
+//
+// ConvertChecked panics in the same cases as Convert.
+func ConvertChecked(p interface{}, maker TagMaker) (res interface{}, changed bool) {
+	converted := convertValue(reflect.ValueOf(p), maker, Options{})
+	if converted.Type() == reflect.TypeOf(p) {
+		return p, false
+	}
+	return converted.Interface(), true
+}
+
+// ConvertWithMapping converts p in the same way as Convert does and additionally returns
+// the mapping of fields of the generated structure to fields of the source one:
+// mapping[i] is the index of the source field for the generated field i. Currently
+// every field (including unexported and blank ones) is kept in its place, so the mapping
+// is the identity, but codecs built on top of the package should rely on the mapping.
+// The mapping is nil if p points to a slice, array or map. The options are applied as ConvertWith does.
+func ConvertWithMapping(p interface{}, maker TagMaker, opts ...Option) (interface{}, []int) {
+	res := ConvertWith(p, maker, opts...)
+	source, generated := reflect.TypeOf(p).Elem(), reflect.TypeOf(res).Elem()
+	if source.Kind() != reflect.Struct {
+		return res, nil
+	}
+	mapping := make([]int, generated.NumField())
+	for i := range mapping {
+		field := generated.Field(i)
+		mapping[i] = -1
+		for j := 0; j < source.NumField(); j++ {
+			if f := source.Field(j); f.Name == field.Name && f.Offset == field.Offset {
+				mapping[i] = j
+				break
+			}
+		}
+	}
+	return res, mapping
+}
+
+// ConvertAll converts every element of ps in the same way as Convert does and returns
+// the results in the same order. The type of every distinct source type is resolved once.
+// ConvertAll panics in the same cases as Convert, the *Error mentions the index
+// of the first element which can't be converted.
+func ConvertAll(ps []interface{}, maker TagMaker) []interface{} {
+	res := make([]interface{}, len(ps))
+	types := make(map[reflect.Type]reflect.Type)
+	for i, p := range ps {
+		v := reflect.ValueOf(p)
+		if !v.IsValid() {
+			panic(errorf(nil, "element %d: unable to convert nil", i))
+		}
+		t, ok := types[v.Type()]
+		if !ok {
+			t = convertElem(i, v, maker)
+			types[v.Type()] = t
+		}
+		res[i] = reflect.NewAt(t, unsafe.Pointer(v.Pointer())).Interface()
+	}
+	return res
+}
+
+func convertElem(i int, v reflect.Value, maker TagMaker) reflect.Type {
+	defer prefixError("element %d: ", i)
+	return convertValue(v, maker, Options{}).Type().Elem()
+}
+
+func convert(p interface{}, maker TagMaker, opts Options) interface{} {
+	return convertValue(reflect.ValueOf(p), maker, opts).Interface()
+}
+
+func convertValue(strPtrVal reflect.Value, maker TagMaker, opts Options) reflect.Value {
+	generated := convertElemType(strPtrVal, maker, opts)
+	if strPtrVal.IsNil() {
+		// the type is known without dereferencing
+		return reflect.Zero(reflect.PointerTo(generated))
+	}
+	t := strPtrVal.Type().Elem()
+	converted := reflect.NewAt(generated, unsafe.Pointer(strPtrVal.Pointer()))
+	if opts.InterfaceCopy && hasInterface(t, map[reflect.Type]bool{}) {
+		copied := reflect.New(generated)
+		copied.Elem().Set(converted.Elem())
+		return copied
+	}
+	return converted
+}
+
+// convertElemType checks the argument of Convert and returns the analogue of the type it points to.
+func convertElemType(strPtrVal reflect.Value, maker TagMaker, opts Options) reflect.Type {
+	switch {
+	case !strPtrVal.IsValid():
+		panic(errorf(nil, "unable to convert nil, a pointer is expected"))
+	case strPtrVal.Kind() != reflect.Pointer:
+		panic(errorf(strPtrVal.Type(), "unable to convert %s, because it is a %s, not a pointer", strPtrVal.Type(), strPtrVal.Kind()))
+	}
+	t := strPtrVal.Type().Elem()
+	checkConvertible(t)
+	if generated, ok := loadCached(t, maker, &opts); ok {
+		return generated
+	}
+	return newConversion(maker, opts).getType(t).t
+}
+
+// loadCached is the fast path of a conversion of a cached type, it makes no per-call state.
+// It applies only to the options which don't need the state of a conversion for a cached type.
+func loadCached(t reflect.Type, maker TagMaker, opts *Options) (reflect.Type, bool) {
+	if opts.NoCache || opts.MaxDepth > 0 || opts.Logger != nil || opts.ctx != nil || opts.ElemMaker != nil {
+		return nil, false
+	}
+	res, ok := cache.loadHit(newCacheKey(t, checkMaker(maker), opts, nil))
+	return res.t, ok && res.finishedProcessing
 }
 
+// hasInterface reports whether the type t has a part of interface type.
+func hasInterface(t reflect.Type, visited map[reflect.Type]bool) bool {
+	if visited[t] {
+		return false
+	}
+	visited[t] = true
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if hasInterface(t.Field(i).Type, visited) {
+				return true
+			}
+		}
+	case reflect.Map:
+		return hasInterface(t.Key(), visited) || hasInterface(t.Elem(), visited)
+	case reflect.Pointer, reflect.Array, reflect.Slice:
+		return hasInterface(t.Elem(), visited)
+	}
+	return false
+}
+
+// checkConvertible panics if the type t can't be the root of a conversion.
+func checkConvertible(t reflect.Type) {
+	switch t.Kind() {
+	case reflect.Struct, reflect.Slice, reflect.Array, reflect.Map:
+	default:
+		panic(errorf(t, "unable to convert %s, because it is not a structure, slice, array or map", t))
+	}
+}
+
+// hashedByRuns reports whether the generated type gen has a part hashed differently than
+// the same part of the source type t: a generated structure with adjacent fields of plain memory,
+// which the compiler hashes as a whole run.
+func hashedByRuns(t, gen reflect.Type) bool {
+	if t == gen {
+		return false
+	}
+	switch gen.Kind() {
+	case reflect.Array:
+		return hashedByRuns(t.Elem(), gen.Elem())
+	case reflect.Struct:
+		// the padding of Options.SizePadding follows the fields of the source type
+		run := 0
+		for i := 0; i < t.NumField(); i++ {
+			field := gen.Field(i)
+			if hashedByRuns(t.Field(i).Type, field.Type) {
+				return true
+			}
+			if field.Name == "_" || !isRegularMemory(field.Type) {
+				run = 0
+				continue
+			}
+			if run++; run > 1 {
+				return true
+			}
+			if isPaddedField(gen, i) {
+				run = 0
+			}
+		}
+	}
+	return false
+}
+
+// isRegularMemory reports whether the compiler hashes and compares values of the type t as plain memory.
+func isRegularMemory(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Bool, reflect.Pointer, reflect.Chan, reflect.UnsafePointer:
+		return true
+	case reflect.Array:
+		return isRegularMemory(t.Elem()) || t.Len() == 0 && t.Elem().Comparable()
+	case reflect.Struct:
+		if t.NumField() == 1 {
+			return t.Field(0).Name != "_" && isRegularMemory(t.Field(0).Type)
+		}
+		for i := 0; i < t.NumField(); i++ {
+			if field := t.Field(i); field.Name == "_" || !isRegularMemory(field.Type) || isPaddedField(t, i) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// isPaddedField reports whether the field i of the structure t is followed by padding.
+func isPaddedField(t reflect.Type, i int) bool {
+	field := t.Field(i)
+	if i+1 < t.NumField() {
+		return field.Offset+field.Type.Size() != t.Field(i+1).Offset
+	}
+	return field.Offset+field.Type.Size() != t.Size()
+}
+
+// IsCyclic reports whether the type t refers to itself directly or through fields,
+// elements or keys of its parts. Cyclic types can't be fully converted, see Convert.
+func IsCyclic(t reflect.Type) bool {
+	return isCyclic(t, map[reflect.Type]bool{}, map[reflect.Type]bool{})
+}
+
+// isCyclic reports whether t refers to a type on the path of types being walked.
+// Types proven acyclic are put into done and not walked again,
+// so shared parts of the type graph are walked once.
+func isCyclic(t reflect.Type, path, done map[reflect.Type]bool) bool {
+	if done[t] {
+		return false
+	}
+	if path[t] {
+		return true
+	}
+	path[t] = true
+	defer delete(path, t)
+	switch t.Kind() {
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if isCyclic(t.Field(i).Type, path, done) {
+				return true
+			}
+		}
+	case reflect.Map:
+		if isCyclic(t.Key(), path, done) || isCyclic(t.Elem(), path, done) {
+			return true
+		}
+	case reflect.Pointer, reflect.Array, reflect.Slice:
+		if isCyclic(t.Elem(), path, done) {
+			return true
+		}
+	}
+	done[t] = true
+	return false
+}
+
+// cacheKey is a key of the cache. The common key of a maker which isn't IdentifiedTagMaker
+// with the default options at the root of a conversion is just the type and the maker,
+// the rest is interned, so hashing of the key stays cheap.
 type cacheKey struct {
 	reflect.Type
+	TagMaker // nil for IdentifiedTagMaker
+	ext      *keyExt
+}
+
+// keyExt is the rest of a key of the cache.
+type keyExt struct {
+	makerType reflect.Type
+	identity  interface{}
+	opts      Options // keyed, see Options.keyed
+	path      *pathNode
+}
+
+// keyExts interns the rests of keys of the cache. Like typeCache, it is looked up
+// in a read-only map which is replaced atomically, so the hit path is lock-free.
+var keyExts = keyExtTable{m: make(map[keyExt]*keyExt)}
+
+type keyExtTable struct {
+	read atomic.Value // map[keyExt]*keyExt, read-only
+
+	mu sync.Mutex
+	// m holds all interned values, readMisses is the number of lookups which missed
+	// the read-only map since it was copied, both are guarded by mu
+	m          map[keyExt]*keyExt
+	readMisses int
+}
+
+// intern returns the interned copy of ext.
+func (t *keyExtTable) intern(ext keyExt) *keyExt {
+	read, _ := t.read.Load().(map[keyExt]*keyExt)
+	if res, ok := read[ext]; ok {
+		return res
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res, ok := t.m[ext]
+	if !ok {
+		res = new(keyExt)
+		*res = ext
+		t.m[ext] = res
+	}
+	if t.readMisses++; t.readMisses >= len(t.m) {
+		t.copyRead()
+	}
+	return res
+}
+
+// copyRead replaces the read-only map by a copy of all interned values, t.mu must be locked.
+func (t *keyExtTable) copyRead() {
+	read := make(map[keyExt]*keyExt, len(t.m))
+	for ext, res := range t.m {
+		read[ext] = res
+	}
+	t.read.Store(read)
+	t.readMisses = 0
+}
+
+// reset drops all interned values.
+func (t *keyExtTable) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.m = make(map[keyExt]*keyExt)
+	t.copyRead()
+}
+
+func newCacheKey(t reflect.Type, mk makerKey, opts *Options, path *pathNode) cacheKey {
+	if mk.makerType == nil && path == nil && opts.affectNothing() {
+		return cacheKey{t, mk.TagMaker, nil}
+	}
+	return cacheKey{t, mk.TagMaker, keyExts.intern(keyExt{mk.makerType, mk.identity, opts.keyed(), path})}
+}
+
+// makerKey returns the key of the maker of the entry.
+func (k cacheKey) makerKey() makerKey {
+	if k.ext == nil {
+		return makerKey{TagMaker: k.TagMaker}
+	}
+	return makerKey{k.TagMaker, k.ext.makerType, k.ext.identity}
+}
+
+// elemMaker returns Options.ElemMaker of the entry.
+func (k cacheKey) elemMaker() TagMaker {
+	if k.ext == nil {
+		return nil
+	}
+	return k.ext.opts.ElemMaker
+}
+
+// makerKey identifies a maker in a key of the cache: it is either the maker itself
+// or the type and the identity of IdentifiedTagMaker.
+type makerKey struct {
 	TagMaker
+	makerType reflect.Type
+	identity  interface{}
+}
+
+func newMakerKey(maker TagMaker) makerKey {
+	if m, ok := maker.(IdentifiedTagMaker); ok {
+		return makerKey{makerType: reflect.TypeOf(maker), identity: m.Identity()}
+	}
+	return makerKey{TagMaker: maker}
 }
 
 type result struct {
-	t        reflect.Type
-	changed  bool
-	hasIface bool
+	t       reflect.Type
+	changed bool
+	// finishedProcessing is false if the type refers to a structure which is still being
+	// converted (a back-edge of a cyclic type), so the result depends on the place of the type
+	// in the conversion and must not get into the cache.
 	finishedProcessing bool
+	// height is the number of levels of nested types, see Options.MaxDepth.
+	height int
+}
+
+// conversion holds the state of a conversion of one type.
+type conversion struct {
+	maker    TagMaker
+	makerKey makerKey
+	opts     Options
+	// seen holds the structures (and named types of other composite kinds) being converted
+	// with their depth in the conversion (from 1).
+	seen map[reflect.Type]int
+	// backEdge is the least depth of structures met as back-edges while making the current type,
+	// zero if there are no such structures.
+	backEdge int
+	// depth is the number of types being made, see Options.MaxDepth,
+	// deepest is the greatest depth reached while making the current type.
+	depth   int
+	deepest int
+	// path is tracked for PathAwareTagMaker only.
+	pathAware bool
+	path      *pathNode
+	// root is the converted type, trail is the way from it to the type being made.
+	root  reflect.Type
+	trail []trailFrame
+}
+
+// trailFrame is a frame of conversion.trail, it is cheaper than PathFrame.
+type trailFrame struct {
+	kind       ContainerKind
+	structType reflect.Type
+	fieldIndex int
+}
+
+// makeLocatedType is makeFinishedType which locates errors raised while making the outermost type,
+// nothing is tracked for a type found in the cache.
+func (c *conversion) makeLocatedType(t reflect.Type) result {
+	if c.root == nil {
+		c.root = t
+		defer c.locateError()
+	}
+	return c.makeFinishedType(t)
+}
+
+// locateError sets the path of *Error raised during the conversion to the trail,
+// it must be deferred directly by makeLocatedType of the outermost type.
+func (c *conversion) locateError() {
+	p := recover()
+	if p == nil {
+		return
+	}
+	if err, ok := p.(*Error); ok && err.Path == "" && len(c.trail) > 0 {
+		path := make(FieldPath, len(c.trail))
+		for i, frame := range c.trail {
+			path[i].Kind = frame.kind
+			if frame.kind == ContainerField {
+				path[i].Struct = frame.structType
+				path[i].Field = frame.structType.Field(frame.fieldIndex)
+			}
+		}
+		root := c.root
+		for root.Kind() == reflect.Pointer && root.Name() == "" {
+			root = root.Elem()
+		}
+		// an unnamed root is omitted, its description can be long
+		if s := path.String(); root.Name() == "" || s == "" || s[0] == '[' {
+			err.Path = root.Name() + s
+		} else {
+			err.Path = root.Name() + "." + s
+		}
+	}
+	panic(p)
+}
+
+func newConversion(maker TagMaker, opts Options) *conversion {
+	checkMaker(maker)
+	if opts.ElemMaker != nil {
+		checkMaker(opts.ElemMaker)
+		// ElemMaker is a part of the key of the cache as is
+		if _, ok := opts.ElemMaker.(IdentifiedTagMaker); ok {
+			checkComparable(reflect.TypeOf(opts.ElemMaker))
+		}
+	}
+	c := &conversion{opts: opts, seen: map[reflect.Type]int{}}
+	c.setMaker(maker)
+	return c
+}
+
+// checkMaker panics if the maker can't be a part of a key of the cache, otherwise it returns
+// the key of the maker as newMakerKey does.
+func checkMaker(maker TagMaker) makerKey {
+	t := reflect.TypeOf(maker)
+	if t == nil {
+		panic(errorf(nil, "retag: TagMaker is nil"))
+	}
+	if m, ok := maker.(IdentifiedTagMaker); ok {
+		identity := m.Identity()
+		if id := reflect.TypeOf(identity); id != nil && !id.Comparable() {
+			panic(errorf(t, "retag: identity of TagMaker type %s has type %s, it must be comparable to be used as a cache key", t, id))
+		}
+		return makerKey{makerType: t, identity: identity}
+	}
+	checkComparable(t)
+	return makerKey{TagMaker: maker}
+}
+
+func checkComparable(t reflect.Type) {
+	if !t.Comparable() {
+		panic(errorf(t, "retag: TagMaker type %s must be comparable to be used as a cache key", t))
+	}
+}
+
+func (c *conversion) setMaker(maker TagMaker) {
+	c.maker = maker
+	c.makerKey = newMakerKey(maker)
+	_, c.pathAware = maker.(PathAwareTagMaker)
+}
+
+// getNestedType is getType for a type nested into the current one.
+// For ContainerField the field is described by the structType and the fieldIndex.
+func (c *conversion) getNestedType(t reflect.Type, kind ContainerKind, structType reflect.Type, fieldIndex int) result {
+	// the frame is not popped on panic, so the trail locates the failure, see locateError
+	c.trail = append(c.trail, trailFrame{kind, structType, fieldIndex})
+	res := c.getContainedType(t, kind, structType, fieldIndex)
+	c.trail = c.trail[:len(c.trail)-1]
+	return res
+}
+
+func (c *conversion) getContainedType(t reflect.Type, kind ContainerKind, structType reflect.Type, fieldIndex int) result {
+	if elemMaker := c.opts.ElemMaker; elemMaker != nil && (kind == ContainerSlice || kind == ContainerArray) {
+		defer c.setMaker(c.maker)
+		c.setMaker(elemMaker)
+	}
+	if !c.pathAware {
+		return c.getType(t)
+	}
+	parent := c.path
+	c.path = parent.child(kind, structType, fieldIndex)
+	defer func() { c.path = parent }()
+	return c.getType(t)
+}
+
+func (c *conversion) getType(structType reflect.Type) result {
+	if ctx := c.opts.ctx; ctx != nil {
+		if err := ctx.Err(); err != nil {
+			panic(canceled{err})
+		}
+	}
+	if depth := c.seen[structType]; depth > 0 {
+		// a back-edge of a cyclic type, see Convert
+		if c.backEdge == 0 || depth < c.backEdge {
+			c.backEdge = depth
+		}
+		return result{t: structType, changed: false}
+	}
+	if c.opts.NoCache {
+		return c.makeLocatedType(structType)
+	}
+	key := newCacheKey(structType, c.makerKey, &c.opts, c.path)
+	res, ok := cache.load(key)
+	ok = ok && res.finishedProcessing
+	if ok {
+		// the cached type is not made again, but its depth is still a part of the conversion
+		c.reach(structType, c.depth+res.height)
+	}
+	if l := c.opts.Logger; l != nil {
+		if ok {
+			l.Printf("retag: cache hit for %s", structType)
+		} else {
+			l.Printf("retag: cache miss for %s", structType)
+		}
+	}
+	if !ok {
+		res = c.makeLocatedType(structType)
+		if !res.finishedProcessing {
+			return res
+		}
+		// The analogue can be produced concurrently by different goroutines.
+		// The construction is not serialized per key because goroutines converting
+		// types which refer to each other would wait for each other. Instead,
+		// the first stored analogue wins, so all callers get the same type.
+		res = cache.store(key, res)
+	}
+	return res
+}
+
+// makeFinishedType is makeType which tracks back-edges met while making the type.
+// The result is finished if the type refers to no structures being converted
+// except the type itself (and structures nested into it).
+// reach records that the conversion of the type t reaches the nesting depth
+// and checks it against Options.MaxDepth.
+func (c *conversion) reach(t reflect.Type, depth int) {
+	if max := c.opts.MaxDepth; max > 0 && depth > max {
+		panic(errorf(t, "unable to convert %s, because its nesting depth exceeds the limit %d", t, max))
+	}
+	if depth > c.deepest {
+		c.deepest = depth
+	}
 }
 
-var cache = struct {
+func (c *conversion) makeFinishedType(t reflect.Type) result {
+	level := 0
+	switch t.Kind() {
+	case reflect.Struct, reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+		level = 1
+	}
+	c.depth += level
+	defer func() { c.depth -= level }()
+	c.reach(t, c.depth)
+	deepest := c.deepest
+	c.deepest = c.depth
+	outer, depth := c.backEdge, len(c.seen)
+	c.backEdge = 0
+	res := c.makeType(t)
+	res.height = c.deepest - c.depth + level
+	if deepest > c.deepest {
+		c.deepest = deepest
+	}
+	if c.backEdge > depth {
+		c.backEdge = 0
+	}
+	res.finishedProcessing = c.backEdge == 0
+	if outer != 0 && (c.backEdge == 0 || outer < c.backEdge) {
+		c.backEdge = outer
+	}
+	return res
+}
+
+// sqlNullTypes are the sql.Null* types.
+var sqlNullTypes = map[reflect.Type]bool{
+	reflect.TypeOf(sql.NullBool{}):    true,
+	reflect.TypeOf(sql.NullByte{}):    true,
+	reflect.TypeOf(sql.NullFloat64{}): true,
+	reflect.TypeOf(sql.NullInt16{}):   true,
+	reflect.TypeOf(sql.NullInt32{}):   true,
+	reflect.TypeOf(sql.NullInt64{}):   true,
+	reflect.TypeOf(sql.NullString{}):  true,
+	reflect.TypeOf(sql.NullTime{}):    true,
+}
+
+// opaqueTypes are left unchanged regardless of their internals.
+var opaqueTypes = struct {
 	sync.RWMutex
-	m map[cacheKey]result
+	m map[reflect.Type]bool
 }{
-	m: make(map[cacheKey]result),
-}
-
-func getType(structType reflect.Type, maker TagMaker, any bool, seen map[string]bool) result {
-	// TODO(yar): Improve synchronization for cases when one analogue
-	// is produced concurently by different goroutines in the same time
-	key := cacheKey{structType, maker}
-	cache.RLock()
-	res, ok := cache.m[key]
-	cache.RUnlock()
-	if !ok || (res.hasIface && !any) {
-		res = makeType(structType, maker, any, seen)
-		cache.Lock()
-		cache.m[key] = res
-		cache.Unlock()
+	m: defaultOpaqueTypes(),
+}
+
+// defaultOpaqueTypes returns the opaque types registered by default.
+func defaultOpaqueTypes() map[reflect.Type]bool {
+	m := map[reflect.Type]bool{
+		reflect.TypeOf(time.Time{}): true,
 	}
-	return res
+	for t := range sqlNullTypes {
+		m[t] = true
+	}
+	return m
+}
+
+// RegisterOpaqueType makes the conversion to leave the type t unchanged regardless of its internals,
+// only tags of fields of the type are changed. It is useful for types with methods
+// (generated types have no methods) and for types with unexported fields.
+// The time.Time and sql.Null* types are registered by default.
+//
+// RegisterOpaqueType should be called before conversions of types which contain t
+// (e.g. in init), because cached analogues are not regenerated.
+func RegisterOpaqueType(t reflect.Type) {
+	opaqueTypes.Lock()
+	opaqueTypes.m[t] = true
+	opaqueTypes.Unlock()
+}
+
+func isOpaque(t reflect.Type) bool {
+	opaqueTypes.RLock()
+	defer opaqueTypes.RUnlock()
+	return opaqueTypes.m[t]
+}
+
+// typeMappers are substitutes of source types, see RegisterTypeMapper.
+var typeMappers = struct {
+	sync.RWMutex
+	m map[reflect.Type]reflect.Type
+}{
+	m: make(map[reflect.Type]reflect.Type),
+}
+
+// RegisterTypeMapper makes the conversion to replace the type from with the type to,
+// e.g. a type with unexported fields with a hand-written mirror with exported ones.
+// The substitute is converted in turn unless it is an opaque type (see RegisterOpaqueType),
+// but it isn't mapped again. A value of the type from is accessed through the type to,
+// so the types must have the same layout in memory; RegisterTypeMapper panics with *Error
+// if they have different sizes or alignments.
+//
+// RegisterTypeMapper should be called before conversions of types which contain from
+// (e.g. in init), because cached analogues are not regenerated.
+func RegisterTypeMapper(from, to reflect.Type) {
+	if from.Size() != to.Size() || from.Align() != to.Align() {
+		panic(errorf(from, "unable to map %s to %s, because they have different sizes or alignments", from, to))
+	}
+	typeMappers.Lock()
+	typeMappers.m[from] = to
+	typeMappers.Unlock()
+}
+
+func mappedType(t reflect.Type) reflect.Type {
+	typeMappers.RLock()
+	defer typeMappers.RUnlock()
+	return typeMappers.m[t]
+}
+
+func (c *conversion) makeType(t reflect.Type) result {
+	if to := mappedType(t); to != nil {
+		res := c.makeSourceType(to)
+		res.changed = true
+		return res
+	}
+	return c.makeSourceType(t)
 }
 
-func makeType(t reflect.Type, maker TagMaker, any bool, seen map[string]bool) result {
+func (c *conversion) makeSourceType(t reflect.Type) result {
+	if isOpaque(t) || c.opts.opaque.contains(t) {
+		return result{t: t, changed: false}
+	}
 	switch t.Kind() {
-	case reflect.Struct:
-		key:=fmt.Sprintf("%s.%s", t.PkgPath(), t.Name())
-		if seen[key] {
-			return result{t: t, changed: false}
+	case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+		if t.Name() != "" {
+			// a named type can refer to itself without a structure (e.g. type Tree map[string][]Tree),
+			// it is guarded as a structure
+			c.seen[t] = len(c.seen) + 1
+			defer delete(c.seen, t)
 		}
-		seen[key] = true
-		return makeStructType(t, maker, any, seen)
-	case reflect.Ptr:
-		res := getType(t.Elem(), maker, any,seen)
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		// the guard is kept for the current path only, the cache handles repeated types
+		c.seen[t] = len(c.seen) + 1
+		defer delete(c.seen, t)
+		return c.makeStructType(t)
+	case reflect.Pointer:
+		res := c.getNestedType(t.Elem(), ContainerPointer, nil, 0)
 		if !res.changed {
 			return result{t: t, changed: false}
 		}
-		return result{t: reflect.PtrTo(res.t), changed: true}
+		return result{t: reflect.PointerTo(res.t), changed: true}
 	case reflect.Array:
-		res := getType(t.Elem(), maker, any,seen)
+		res := c.getNestedType(t.Elem(), ContainerArray, nil, 0)
 		if !res.changed {
 			return result{t: t, changed: false}
 		}
 		return result{t: reflect.ArrayOf(t.Len(), res.t), changed: true}
 	case reflect.Slice:
-		res := getType(t.Elem(), maker, any,seen)
+		res := c.getNestedType(t.Elem(), ContainerSlice, nil, 0)
 		if !res.changed {
 			return result{t: t, changed: false}
 		}
 		return result{t: reflect.SliceOf(res.t), changed: true}
 	case reflect.Map:
-		resKey := getType(t.Key(), maker, any,seen)
-		resElem := getType(t.Elem(), maker, any,seen)
+		resKey := c.getNestedType(t.Key(), ContainerMapKey, nil, 0)
+		resElem := c.getNestedType(t.Elem(), ContainerMapValue, nil, 0)
 		if !resKey.changed && !resElem.changed {
 			return result{t: t, changed: false}
 		}
+		// The map is accessed through the generated type, so the key must be hashed
+		// and compared in the same way. A generated structure has the same fields
+		// as the source one except tags, but it is hashed field by field, while the compiler
+		// hashes a run of plain memory spanning several fields at once.
+		if k := resKey.t; resKey.changed && (k.Size() != t.Key().Size() && !c.opts.structTags || !k.Comparable()) {
+			panic(errorf(t, "unable to convert %s, because the generated key type %s is not compatible with the source one", t, k))
+		}
+		if k := resKey.t; resKey.changed && !c.opts.structTags && hashedByRuns(t.Key(), k) {
+			panic(errorf(t, "unable to convert %s, because the generated key type %s is hashed differently than the source one: "+
+				"adjacent fields of integers, booleans or pointers are hashed at once by the compiler", t, k))
+		}
 		return result{t: reflect.MapOf(resKey.t, resElem.t), changed: true}
 	case reflect.Interface:
-		if any {
-			return result{t: t, changed: false, hasIface: true}
+		if c.opts.Any || c.opts.InterfaceCopy {
+			return result{t: t, changed: false}
 		}
 		fallthrough
 	case
 		reflect.Chan,
 		reflect.Func,
 		reflect.UnsafePointer:
-		panic("tags.Map: Unsupported type: " + t.Kind().String())
+		if c.opts.PassthroughUnsupported {
+			return result{t: t, changed: false}
+		}
+		panic(errorf(t, "tags.Map: Unsupported type: %s", t.Kind()))
 	default:
 		// don't modify type in another case
 		return result{t: t, changed: false}
 	}
 }
 
-func makeStructType(structType reflect.Type, maker TagMaker, any bool, seen map[string]bool) result {
+func (c *conversion) makeStructType(structType reflect.Type) result {
 	if structType.NumField() == 0 {
 		return result{t: structType, changed: false}
 	}
+	if max := c.opts.MaxFields; max > 0 && structType.NumField() > max {
+		panic(errorf(structType, "unable to convert type %s, because it has %d fields, more than the limit %d",
+			structType, structType.NumField(), max))
+	}
 	changed := false
 	hasPrivate := false
-	hasIface := false
 	fields := make([]reflect.StructField, 0, structType.NumField())
 	for i := 0; i < structType.NumField(); i++ {
 		strField := structType.Field(i)
-		if isExported(strField.Name) {
+		if IsExportedName(strField.Name) {
 			oldType := strField.Type
-			new := getType(oldType, maker, any,seen)
+			var new result
+			if d, ok := c.maker.(FieldOpaqueDecider); ok && d.ShouldTreatAsOpaque(structType, i) {
+				new = result{t: oldType, changed: false}
+			} else {
+				new = c.getNestedType(oldType, ContainerField, structType, i)
+			}
 			strField.Type = new.t
 			if oldType != new.t {
 				changed = true
 			}
-			if new.hasIface {
-				hasIface = true
+			if c.opts.StripMethods {
+				if stripped := stripMethods(strField); stripped.Type != strField.Type || stripped.Anonymous != strField.Anonymous {
+					strField = stripped
+					changed = true
+				}
 			}
 			oldTag := strField.Tag
-			newTag := maker.MakeTag(structType, i)
+			// There is no sense to intern generated tags, reflect.StructOf
+			// copies every tag into the name data of the new type.
+			newTag := KeepTag
+			if c.opts.fields == nil || c.opts.fields.contains(strField.Name) {
+				newTag = c.makeTag(structType, i, new.t)
+			}
+			// only the tags made by the maker are validated, kept ones are not its output
+			validate := c.opts.ValidateTags && newTag != KeepTag
+			if newTag == KeepTag {
+				newTag = oldTag
+			}
+			if validate {
+				if _, err := ParseStructTag(newTag); err != nil && newTag == oldTag {
+					panic(errorf(structType, "the source type %s has malformed tag `%s` of the field %d (%s)", structType, newTag, i, strField.Name))
+				} else if err != nil {
+					panic(errorf(structType, "the maker made malformed tag `%s` for the field %d (%s) of %s", newTag, i, strField.Name, structType))
+				}
+			}
+			if hook := c.opts.fieldHook; hook != nil {
+				(*hook)(structType, i, oldTag, newTag)
+			}
 			strField.Tag = newTag
 			if oldTag != newTag {
 				changed = true
+				if l := c.opts.Logger; l != nil {
+					l.Printf("retag: tag of field %s of %s changed from `%s` to `%s`", strField.Name, structType, oldTag, newTag)
+				}
 			}
+		} else if strField.Name == "_" && structTypeConstructorBugWasFixed {
+			// blank fields (e.g. `_ struct{}` to force keyed literals)
+			// are copied as is, they can't be accessed anyway
 		} else {
 			hasPrivate = true
 			if !structTypeConstructorBugWasFixed {
@@ -192,43 +1097,170 @@ func makeStructType(structType reflect.Type, maker TagMaker, any bool, seen map[
 		}
 		fields = append(fields, strField)
 	}
+	if m, ok := c.maker.(StructTagMaker); ok && c.opts.structTags {
+		if marker, ok := makeMarkerField(m, structType); ok {
+			fields = append(fields, marker)
+			changed = true
+		}
+	}
 	if !changed {
-		return result{t: structType, changed: false, hasIface: hasIface}
-	} else if hasPrivate {
-		panic(fmt.Sprintf("unable to change tags for type %s, because it contains unexported fields", structType))
+		return result{t: structType, changed: false}
+	} else if hasPrivate && !(c.opts.Unexported == UnexportedKeep && structTypeConstructorBugWasFixed) {
+		if c.opts.Unexported == UnexportedSkip {
+			return result{t: structType, changed: false}
+		}
+		panic(errorf(structType, "unable to change tags for type %s, because it contains unexported fields", structType))
+	} else if last := fields[len(fields)-1]; !trailingZeroSizeFieldBugWasFixed && last.Type.Size() == 0 && !c.opts.SizePadding {
+		// reflect.StructOf doesn't add padding after a final zero-size field,
+		// so the generated type would be smaller than the source one.
+		// see issue https://github.com/golang/go/issues/18016
+		panic(errorf(structType, "unable to change tags for type %s, because its final field %s has zero size", structType, last.Name))
 	}
 	newType := reflect.StructOf(fields)
-	compareStructTypes(structType, newType)
-	return result{t: newType, changed: true, hasIface: hasIface}
+	if c.opts.SizePadding && newType.Size() < structType.Size() {
+		newType = reflect.StructOf(append(fields, paddingField(structType.Size()-newType.Size())))
+	}
+	if !c.opts.structTags {
+		// the types with marker fields are not aliased, so they may have another layout
+		compareStructTypes(structType, newType)
+	}
+	if c.opts.CheckEmbedded {
+		checkEmbedded(structType, newType)
+	}
+	if l := c.opts.Logger; l != nil {
+		l.Printf("retag: generated type for %s", structType)
+	}
+	return result{t: newType, changed: true}
 }
 
-func isExported(name string) bool {
-	b := name[0]
-	return !('a' <= b && b <= 'z') && b != '_'
+func (c *conversion) makeTag(structType reflect.Type, fieldIndex int, resolved reflect.Type) reflect.StructTag {
+	if m, ok := c.maker.(PathAwareTagMaker); ok {
+		return m.MakeTagPath(structType, fieldIndex, c.path.path())
+	}
+	return makeFieldTag(c.maker, newFieldInfo(structType, fieldIndex, resolved))
 }
 
+// makeFieldTag calls the method of the maker which makes the tag of the field,
+// except MakeTagPath of PathAwareTagMaker.
+func makeFieldTag(maker TagMaker, field FieldInfo) reflect.StructTag {
+	switch m := maker.(type) {
+	case ResolvedTagMaker:
+		return m.MakeResolvedTag(field)
+	case TagTransformer:
+		return m.TransformTag(field.Struct, field.Index, field.Field.Tag)
+	}
+	return maker.MakeTag(field.Struct, field.Index)
+}
+
+// IsExportedName reports whether the name of a field is exported by the rules of the Go specification:
+// the first character of the name is an Unicode upper case letter. The blank identifier "_"
+// and names started with "_" are not exported.
+func IsExportedName(name string) bool {
+	r, _ := utf8.DecodeRuneInString(name)
+	return unicode.IsUpper(r)
+}
+
+// compareStructTypes panics if the memory layout of the generated type differs from the source one,
+// a value of the source type is accessed through the generated type, so every field must keep its offset.
 func compareStructTypes(source, result reflect.Type) {
 	if source.Size() != result.Size() {
-		// TODO: debug
-		// fmt.Println(newType.Size(), newType)
-		// for i := 0; i < newType.NumField(); i++ {
-		// 	fmt.Println(newType.Field(i))
-		// }
-		// fmt.Println(structType.Size(), structType)
-		// for i := 0; i < structType.NumField(); i++ {
-		// 	fmt.Println(structType.Field(i))
-		// }
-		panic("tags.Map: Unexpected case - type has a size different from size of original type")
+		if n := source.NumField(); n > 0 && source.Field(n-1).Type.Size() == 0 && result.Size() < source.Size() {
+			// reflect.StructOf of go1.7 doesn't add padding after a final zero-size field,
+			// see issue https://github.com/golang/go/issues/18016
+			panic(errorf(source, "unable to change tags for type %s, because its final field %s has zero size and the generated type is not padded",
+				source, source.Field(n-1).Name))
+		}
+		panic(errorf(source, "tags.Map: Unexpected case - type has a size different from size of original type"))
+	}
+	if n := result.NumField(); n == source.NumField()+1 && isPaddingField(result.Field(n-1)) {
+		// the padding is checked by the size
+	} else if source.NumField() != result.NumField() {
+		panic(errorf(source, "tags.Map: Unexpected case - type has %d fields instead of %d", result.NumField(), source.NumField()))
+	}
+	for i := 0; i < source.NumField(); i++ {
+		if a, b := source.Field(i).Offset, result.Field(i).Offset; a != b {
+			panic(errorf(source, "tags.Map: Unexpected case - field %s has offset %d instead of %d", source.Field(i).Name, b, a))
+		}
+	}
+}
+
+// makeMarkerField makes the marker field of the structure, see StructTagMaker.
+func makeMarkerField(m StructTagMaker, structType reflect.Type) (reflect.StructField, bool) {
+	name, tag, ok := m.MakeStructTag(structType)
+	if !ok {
+		return reflect.StructField{}, false
+	}
+	if !IsExportedName(name) {
+		panic(errorf(structType, "the maker made the marker field %q of %s, but its name is not exported", name, structType))
+	}
+	if _, ok := structType.FieldByName(name); ok {
+		panic(errorf(structType, "the maker made the marker field %s of %s, but the structure has such a field", name, structType))
+	}
+	return reflect.StructField{Name: name, Type: reflect.TypeOf(struct{}{}), Tag: tag}, true
+}
+
+// paddingTag hides padding fields from encoding/json, see Options.SizePadding.
+const paddingTag reflect.StructTag = `json:"-"`
+
+// paddingField makes a blank field of the size.
+func paddingField(size uintptr) reflect.StructField {
+	return reflect.StructField{
+		Name:    "_",
+		PkgPath: reflect.TypeOf(Options{}).PkgPath(),
+		Type:    reflect.ArrayOf(int(size), reflect.TypeOf(byte(0))),
+		Tag:     paddingTag,
 	}
 }
 
-var structTypeConstructorBugWasFixed bool
+func isPaddingField(field reflect.StructField) bool {
+	return field.Name == "_" && field.Tag == paddingTag &&
+		field.Type.Kind() == reflect.Array && field.Type.Elem().Kind() == reflect.Uint8
+}
+
+var (
+	structTypeConstructorBugWasFixed bool
+	trailingZeroSizeFieldBugWasFixed bool
+)
 
 func init() {
-	switch {
-	case strings.HasPrefix(runtime.Version(), "go1.7"):
-		// there is bug in reflect.StructOf
-	default:
-		structTypeConstructorBugWasFixed = true
+	structTypeConstructorBugWasFixed = structOfKeepsUnexportedFields()
+	trailingZeroSizeFieldBugWasFixed = structOfPadsTrailingZeroSizeField()
+}
+
+// structOfKeepsUnexportedFields probes whether reflect.StructOf constructs a structure
+// with an unexported field correctly. It is not so in go1.7,
+// see issue https://github.com/golang/go/issues/17766
+func structOfKeepsUnexportedFields() (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	type probe struct {
+		X int8
+		y int64
+	}
+	source := reflect.TypeOf(probe{})
+	t := reflect.StructOf([]reflect.StructField{source.Field(0), source.Field(1)})
+	f := t.Field(1)
+	return t.Size() == source.Size() && f.Name == "y" && f.PkgPath == source.Field(1).PkgPath &&
+		f.Offset == source.Field(1).Offset
+}
+
+// structOfPadsTrailingZeroSizeField probes whether reflect.StructOf adds padding after a final
+// zero-size field as the compiler does. It is not so in go1.7,
+// see issue https://github.com/golang/go/issues/18016
+func structOfPadsTrailingZeroSizeField() (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	type probe struct {
+		X int64
+		Y struct{}
 	}
+	source := reflect.TypeOf(probe{})
+	t := reflect.StructOf([]reflect.StructField{source.Field(0), source.Field(1)})
+	return t.Size() == source.Size()
 }
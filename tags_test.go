@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 	"unicode"
@@ -151,6 +152,891 @@ func TestConvertAny(test *testing.T) {
 	}
 }
 
+func TestConvertE(test *testing.T) {
+	test.Run("Success", func(test *testing.T) {
+		p, err := ConvertE(new(FlatStruct), maker{})
+		if err != nil {
+			test.Fatal(err)
+		}
+		(&MapTestCase{Result: `{"Xport":0}`}).checkResult(p, test)
+	})
+	test.Run("Unsupported", func(test *testing.T) {
+		p, err := ConvertE(new(struct{ I interface{} }), maker{})
+		if _, ok := err.(*Error); !ok || p != nil {
+			test.Errorf("Expect *Error but got %v, %v", p, err)
+		}
+	})
+	test.Run("ChangedWithUnexported", func(test *testing.T) {
+		source := reflect.TypeOf(struct {
+			private int
+			Omit    int
+		}{})
+		_, err := ConvertE(reflect.New(source).Interface(), maker{})
+		if e, ok := err.(*Error); !ok || e.Type != source {
+			test.Errorf("Expect *Error for %s but got %v", source, err)
+		}
+	})
+}
+
+func TestTrailingZeroSizeField(test *testing.T) {
+	defer func(fixed bool) { trailingZeroSizeFieldBugWasFixed = fixed }(trailingZeroSizeFieldBugWasFixed)
+	trailingZeroSizeFieldBugWasFixed = false
+
+	// the types must neither come from the cache nor get there while the bug is emulated
+	uncached := Options{NoCache: true}
+	_, err := uncached.Convert(new(AnonymousVoidStruct), Snaker("json"))
+	if err == nil || !strings.Contains(err.Error(), "final field Xvoid has zero size") {
+		test.Errorf("Expect error about final zero-size field but got %v", err)
+	}
+	if _, err := uncached.Convert(new(VoidFirst), Snaker("json")); err != nil {
+		test.Errorf("Unexpected error for a leading zero-size field: %v", err)
+	}
+}
+
+func TestStructOfProbes(test *testing.T) {
+	// the supported toolchains have reflect.StructOf without the bugs of go1.7
+	if !structOfKeepsUnexportedFields() {
+		test.Error("Expect reflect.StructOf to keep unexported fields")
+	}
+	if !structOfPadsTrailingZeroSizeField() {
+		test.Error("Expect reflect.StructOf to pad a final zero-size field")
+	}
+}
+
+func TestConvertPointer(test *testing.T) {
+	if reflect.Pointer != reflect.Ptr {
+		test.Fatal("reflect.Pointer should be an alias of reflect.Ptr")
+	}
+	result := reflect.TypeOf(Convert(new(PtrStruct), maker{}))
+	if result.Kind() != reflect.Pointer {
+		test.Fatalf("Expect pointer but got %s", result.Kind())
+	}
+	field := result.Elem().Field(1)
+	if field.Type.Kind() != reflect.Pointer || field.Type == reflect.TypeOf(&FlatStruct{}) {
+		test.Errorf("Expect a pointer to generated type but got %s", field.Type)
+	}
+	if tag := field.Type.Elem().Field(0).Tag; tag != `json:"-"` {
+		test.Errorf("Expect retagged element but got `%s`", tag)
+	}
+}
+
+type DeepPtrStruct struct {
+	XPtr2 **FlatStruct
+	XPtr3 ***FlatStruct
+}
+
+func TestConvertDeepPointers(test *testing.T) {
+	inner := &FlatStruct{Omit: 1, Xport: 2}
+	inner2 := &inner
+	p := &DeepPtrStruct{XPtr2: inner2, XPtr3: &inner2}
+	result := Convert(p, maker{})
+	(&MapTestCase{Result: `{"XPtr2":{"Xport":2},"XPtr3":{"Xport":2}}`}).checkResult(result, test)
+	generated := reflect.TypeOf(result).Elem()
+	for i, depth := range []int{2, 3} {
+		t := generated.Field(i).Type
+		for j := 0; j < depth; j++ {
+			if t.Kind() != reflect.Pointer || t.Size() != unsafe.Sizeof(uintptr(0)) {
+				test.Fatalf("Expect a pointer at the level %d of the field %d but got %s", j, i, t)
+			}
+			t = t.Elem()
+		}
+		if tag := t.Field(0).Tag; tag != `json:"-"` {
+			test.Errorf("Expect retagged element but got `%s`", tag)
+		}
+	}
+}
+
+type Celsius float64
+
+type NamedScalarStruct struct {
+	Timeout     time.Duration
+	Temperature Celsius
+}
+
+func TestConvertNamedScalars(test *testing.T) {
+	p := &NamedScalarStruct{Timeout: time.Second, Temperature: 36.6}
+	result := Convert(p, Snaker("json"))
+	(&MapTestCase{Result: `{"timeout":1000000000,"temperature":36.6}`}).checkResult(result, test)
+	source := reflect.TypeOf(p).Elem()
+	generated := reflect.TypeOf(result).Elem()
+	for i := 0; i < source.NumField(); i++ {
+		if generated.Field(i).Type != source.Field(i).Type {
+			test.Errorf("Expect type %s but got %s", source.Field(i).Type, generated.Field(i).Type)
+		}
+	}
+}
+
+type PtrKeyMapStruct struct {
+	XportMap map[*FlatStruct]FlatStruct
+}
+
+func TestConvertPtrKeyMap(test *testing.T) {
+	key := &FlatStruct{Xport: 1}
+	p := &PtrKeyMapStruct{XportMap: map[*FlatStruct]FlatStruct{key: {Xport: 2}}}
+	result := reflect.ValueOf(Convert(p, maker{})).Elem().Field(0)
+	keyType := result.Type().Key()
+	if keyType.Kind() != reflect.Pointer || keyType == reflect.TypeOf(key) {
+		test.Fatalf("Expect a pointer to generated type but got %s", keyType)
+	}
+	if tag := keyType.Elem().Field(0).Tag; tag != `json:"-"` {
+		test.Errorf("Expect retagged key but got `%s`", tag)
+	}
+	if result.Len() != 1 {
+		test.Fatalf("Expect 1 element but got %d", result.Len())
+	}
+	value := result.MapIndex(reflect.NewAt(keyType.Elem(), unsafe.Pointer(key)))
+	if !value.IsValid() || value.Field(1).Int() != 2 {
+		test.Errorf("Unable to get the value by the converted key")
+	}
+	iter := result.MapRange()
+	for iter.Next() {
+		if iter.Key().Pointer() != uintptr(unsafe.Pointer(key)) {
+			test.Error("Expect the key to point to the source key")
+		}
+	}
+}
+
+type TagHolderStruct struct {
+	Tag  reflect.StructTag `json:"x"`
+	Name string
+}
+
+func TestConvertStructTagField(test *testing.T) {
+	p := &TagHolderStruct{Tag: `json:"-" view:"admin"`, Name: "n"}
+	result := Convert(p, Snaker("json"))
+	(&MapTestCase{Result: `{"x":"json:\"-\" view:\"admin\"","name":"n"}`}).checkResult(result, test)
+	field := reflect.TypeOf(result).Elem().Field(0)
+	if field.Type != reflect.TypeOf(reflect.StructTag("")) {
+		test.Errorf("Expect type reflect.StructTag but got %s", field.Type)
+	}
+	if field.Tag != `json:"x"` {
+		test.Errorf("Expect tag `json:\"x\"` but got `%s`", field.Tag)
+	}
+}
+
+type OmitEmpty string
+
+func (m OmitEmpty) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	return reflect.StructTag(fmt.Sprintf(`%s:",omitempty"`, string(m)))
+}
+
+func wideStructType(n int) reflect.Type {
+	fields := make([]reflect.StructField, n)
+	for i := range fields {
+		fields[i] = reflect.StructField{Name: fmt.Sprintf("F%d", i), Type: reflect.TypeOf(0)}
+	}
+	return reflect.StructOf(fields)
+}
+
+func BenchmarkConvertWide(b *testing.B) {
+	p := reflect.New(wideStructType(64)).Interface()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		ClearCache()
+		b.StartTimer()
+		Convert(p, OmitEmpty("json"))
+	}
+}
+
+func TestIsExportedName(test *testing.T) {
+	cases := []struct {
+		name     string
+		exported bool
+	}{
+		{"", false},
+		{"_", false},
+		{"_X", false},
+		{"x", false},
+		{"xY", false},
+		{"X", true},
+		{"Xport", true},
+		{"X_1", true},
+		{"Ätsch", true},
+		{"ätsch", false},
+		{"Ω", true},
+		{"ω", false},
+		{"日本", false},
+		{"ǅ", false}, // title case is not upper case
+	}
+	for _, c := range cases {
+		if got := IsExportedName(c.name); got != c.exported {
+			test.Errorf("Expect IsExportedName(%q) = %v but got %v", c.name, c.exported, got)
+		}
+	}
+}
+
+type BlankFieldStruct struct {
+	_     struct{}
+	Omit  int
+	Xport int
+	_     [0]func()
+}
+
+func TestConvertBlankFields(test *testing.T) {
+	p := &BlankFieldStruct{Omit: 1, Xport: 2}
+	result := Convert(p, maker{})
+	(&MapTestCase{Result: `{"Xport":2}`}).checkResult(result, test)
+	source := reflect.TypeOf(p).Elem()
+	generated := reflect.TypeOf(result).Elem()
+	if generated == source || generated.NumField() != source.NumField() {
+		test.Fatalf("Unexpected generated type %s", generated)
+	}
+	for i := 0; i < source.NumField(); i++ {
+		if generated.Field(i).Name != source.Field(i).Name || generated.Field(i).Offset != source.Field(i).Offset {
+			test.Errorf("Field %d differs: %v and %v", i, generated.Field(i), source.Field(i))
+		}
+	}
+}
+
+type FlatAlias = FlatStruct
+
+func TestConvertAlias(test *testing.T) {
+	original := reflect.TypeOf(Convert(new(FlatStruct), Snaker("json")))
+	alias := reflect.TypeOf(Convert(new(FlatAlias), Snaker("json")))
+	if original != alias {
+		test.Errorf("Expect the same type for the alias but got %s and %s", original, alias)
+	}
+	outer := reflect.TypeOf(Convert(new(struct{ F FlatAlias }), Snaker("json"))).Elem()
+	if outer.Field(0).Type != original.Elem() {
+		test.Errorf("Expect the same type for the field but got %s", outer.Field(0).Type)
+	}
+}
+
+func TestConvertAnyValue(test *testing.T) {
+	source := &FlatStruct{Omit: 1, Xport: 2}
+	values := map[string]interface{}{"ptr": source, "value": *source}
+
+	res, err := ConvertAnyValue(values["ptr"], maker{})
+	if err != nil {
+		test.Fatal(err)
+	}
+	(&MapTestCase{Result: `{"Xport":2}`}).checkResult(res, test)
+	if reflect.ValueOf(res).Pointer() != reflect.ValueOf(source).Pointer() {
+		test.Error("Expect the result to share memory with the source pointer")
+	}
+
+	res, err = ConvertAnyValue(values["value"], maker{})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if reflect.TypeOf(res).Kind() != reflect.Struct {
+		test.Errorf("Expect structure but got %s", reflect.TypeOf(res))
+	}
+	(&MapTestCase{Result: `{"Xport":2}`}).checkResult(res, test)
+
+	for _, v := range []interface{}{nil, 1, new(int), []FlatStruct{}} {
+		if _, err := ConvertAnyValue(v, maker{}); err == nil {
+			test.Errorf("Expect an error for %#v", v)
+		}
+	}
+}
+
+// cacheLineMaker tags fields crossing a boundary of 64-byte cache lines.
+type cacheLineMaker struct{}
+
+func (cacheLineMaker) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	return t.Field(fieldIndex).Tag
+}
+
+func (cacheLineMaker) MakeResolvedTag(field FieldInfo) reflect.StructTag {
+	const line = 64
+	first, last := field.Layout.Offset/line, (field.Layout.Offset+field.Layout.Size-1)/line
+	if field.Layout.Size > 0 && first != last {
+		return `cacheline:"split"`
+	}
+	return field.Field.Tag
+}
+
+// Offsets on 64-bit platforms are in comments.
+type CacheLineStruct struct {
+	A [60]byte // [0, 60)
+	B int64    // [64, 72)
+	C [62]byte // [72, 134), split
+	D int32    // [136, 140)
+	E [56]byte // [140, 196), split
+	F int64    // [200, 208)
+	G [3]int64 // [208, 232)
+}
+
+func TestFieldLayoutInfo(test *testing.T) {
+	p := new(CacheLineStruct)
+	t := reflect.TypeOf(Convert(p, cacheLineMaker{})).Elem()
+	offsets := []uintptr{
+		unsafe.Offsetof(p.A), unsafe.Offsetof(p.B), unsafe.Offsetof(p.C), unsafe.Offsetof(p.D),
+		unsafe.Offsetof(p.E), unsafe.Offsetof(p.F), unsafe.Offsetof(p.G),
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		end := offsets[i] + field.Type.Size() - 1
+		expectSplit := offsets[i]/64 != end/64
+		if got := field.Tag == `cacheline:"split"`; got != expectSplit {
+			test.Errorf("Field %s at %d: expect split %v but got %v", field.Name, field.Offset, expectSplit, got)
+		}
+	}
+}
+
+type AnonymousFieldTypeStruct struct {
+	Xport struct {
+		Omit  int
+		Xport int
+	}
+}
+
+func TestConvertAnonymousFieldType(test *testing.T) {
+	result := Convert(new(AnonymousFieldTypeStruct), maker{})
+	(&MapTestCase{Result: `{"Xport":{"Xport":0}}`}).checkResult(result, test)
+	field := reflect.TypeOf(result).Elem().Field(0)
+	if field.PkgPath != "" || !field.IsExported() {
+		test.Errorf("Expect exported field but got PkgPath %q", field.PkgPath)
+	}
+	if field.Type.Name() != "" || field.Type.PkgPath() != "" {
+		test.Errorf("Expect anonymous type but got %s", field.Type)
+	}
+	if tag := field.Type.Field(0).Tag; tag != `json:"-"` {
+		test.Errorf("Expect retagged sub-field but got `%s`", tag)
+	}
+}
+
+func TestConvertTo(test *testing.T) {
+	p := &FlatStruct{Omit: 1, Xport: 2}
+	res := ConvertTo(p, maker{})
+	(&MapTestCase{Result: `{"Xport":2}`}).checkResult(res, test)
+	if reflect.ValueOf(res).Pointer() != reflect.ValueOf(p).Pointer() {
+		test.Error("Expect the result to share memory with the source")
+	}
+	defer shouldPanic(test)
+	ConvertTo(new(struct{ F func() }), maker{})
+}
+
+type opaqueStruct struct {
+	Omit  int
+	Xport int
+}
+
+func (opaqueStruct) Method() {}
+
+func TestRegisterOpaqueType(test *testing.T) {
+	type Holder struct {
+		Omit   int
+		At     time.Time
+		Opaque opaqueStruct
+		List   []opaqueStruct
+	}
+	RegisterOpaqueType(reflect.TypeOf(opaqueStruct{}))
+	defer Reset()
+	result := reflect.TypeOf(Convert(new(Holder), maker{})).Elem()
+	if tag := result.Field(0).Tag; tag != `json:"-"` {
+		test.Errorf("Expect retagged field but got `%s`", tag)
+	}
+	expected := []reflect.Type{
+		reflect.TypeOf(time.Time{}),
+		reflect.TypeOf(opaqueStruct{}),
+		reflect.TypeOf([]opaqueStruct{}),
+	}
+	for i, t := range expected {
+		if got := result.Field(i + 1).Type; got != t {
+			test.Errorf("Expect type %s but got %s", t, got)
+		}
+	}
+	if _, ok := result.Field(2).Type.MethodByName("Method"); !ok {
+		test.Error("Expect the opaque type to keep its methods")
+	}
+}
+
+// omitEmptier appends omitempty option to existing json tags.
+type omitEmptier struct{}
+
+func (omitEmptier) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	panic("TransformTag should be called instead")
+}
+
+func (omitEmptier) TransformTag(t reflect.Type, fieldIndex int, oldTag reflect.StructTag) reflect.StructTag {
+	value, ok := oldTag.Lookup("json")
+	if !ok || value == "-" {
+		return oldTag
+	}
+	return setTagValue(oldTag, "json", value+",omitempty")
+}
+
+func TestTagTransformer(test *testing.T) {
+	type Profile struct {
+		Name  string `validate:"required" json:"name"`
+		Note  string `json:"note" db:"note"`
+		Plain string
+	}
+	result := reflect.TypeOf(Convert(new(Profile), omitEmptier{})).Elem()
+	expected := []reflect.StructTag{
+		`validate:"required" json:"name,omitempty"`,
+		`json:"note,omitempty" db:"note"`,
+		``,
+	}
+	for i, tag := range expected {
+		if got := result.Field(i).Tag; got != tag {
+			test.Errorf("Expect `%s` but got `%s`", tag, got)
+		}
+	}
+}
+
+func TestConvertContainerPointer(test *testing.T) {
+	cases := []struct {
+		p      interface{}
+		result string
+	}{
+		{&[]FlatStruct{{Omit: 1, Xport: 2}}, `[{"Xport":2}]`},
+		{&[1]FlatStruct{{Omit: 1, Xport: 2}}, `[{"Xport":2}]`},
+		{&map[string]FlatStruct{"a": {Omit: 1, Xport: 2}}, `{"a":{"Xport":2}}`},
+		{&[]*FlatStruct{{Omit: 1, Xport: 2}}, `[{"Xport":2}]`},
+	}
+	for _, c := range cases {
+		result := Convert(c.p, maker{})
+		t := reflect.TypeOf(result)
+		if t.Kind() != reflect.Pointer || t.Elem().Kind() != reflect.TypeOf(c.p).Elem().Kind() {
+			test.Errorf("Unexpected type %s for %T", t, c.p)
+		}
+		(&MapTestCase{Result: c.result}).checkResult(result, test)
+	}
+	test.Run("Scalar", func(test *testing.T) {
+		defer shouldPanic(test)
+		Convert(new(int), maker{})
+	})
+}
+
+func TestConvertValue(test *testing.T) {
+	p := &FlatStruct{Omit: 1, Xport: 2}
+	v := ConvertValue(reflect.ValueOf(p), maker{})
+	if v.Type() != reflect.TypeOf(Convert(p, maker{})) {
+		test.Errorf("Expect the same type as Convert returns but got %s", v.Type())
+	}
+	if v.Pointer() != reflect.ValueOf(p).Pointer() {
+		test.Error("Expect the result to share memory with the source")
+	}
+	(&MapTestCase{Result: `{"Xport":2}`}).checkResult(v.Interface(), test)
+	test.Run("NotPointer", func(test *testing.T) {
+		defer shouldPanic(test)
+		ConvertValue(reflect.ValueOf(*p), maker{})
+	})
+}
+
+func TestAnonymousStructFields(test *testing.T) {
+	p := new(struct {
+		XA struct{ Omit, Xport int }
+		XB struct{ Omit, Xport string }
+	})
+	v := reflect.ValueOf(Convert(p, maker{})).Elem()
+	for _, name := range []string{"XA", "XB"} {
+		if tag := v.FieldByName(name).Type().Field(0).Tag; tag != `json:"-"` {
+			test.Errorf("Expect the field %s to be retagged but got `%s`", name, tag)
+		}
+	}
+}
+
+type AlignedStruct struct {
+	Xbyte  byte
+	Xint64 int64
+	Xint16 int16
+	Xarray [3]byte
+	Xint32 int32
+	Xvoid  struct{}
+}
+
+func TestFieldOffsets(test *testing.T) {
+	source := reflect.TypeOf(AlignedStruct{})
+	generated := reflect.TypeOf(Convert(new(AlignedStruct), Snaker("json"))).Elem()
+	for i := 0; i < source.NumField(); i++ {
+		if a, b := source.Field(i).Offset, generated.Field(i).Offset; a != b {
+			test.Errorf("Expect offset %d of the field %s but got %d", a, source.Field(i).Name, b)
+		}
+	}
+
+	test.Run("Mixed", func(test *testing.T) {
+		// int64 is 4-byte aligned on 386 and 8-byte aligned on amd64,
+		// the offsets must match on both (GOARCH=386 go test)
+		type mixed struct {
+			Xbool   bool
+			Xint64  int64
+			Xint32  int32
+			Xstring string
+			Xflag   bool
+			Xinner  struct {
+				Xint32 int32
+				Xint64 int64
+			}
+			Xlast bool
+		}
+		source := reflect.TypeOf(mixed{})
+		generated := reflect.TypeOf(Convert(new(mixed), Snaker("json"))).Elem()
+		if source.Size() != generated.Size() {
+			test.Errorf("Expect size %d but got %d", source.Size(), generated.Size())
+		}
+		for i := 0; i < source.NumField(); i++ {
+			if a, b := source.Field(i).Offset, generated.Field(i).Offset; a != b {
+				test.Errorf("Expect offset %d of the field %s but got %d", a, source.Field(i).Name, b)
+			}
+		}
+	})
+
+	test.Run("Mismatch", func(test *testing.T) {
+		defer shouldPanic(test)
+		compareStructTypes(
+			reflect.TypeOf(struct {
+				A int16
+				B [2]int8
+				C int32
+			}{}),
+			reflect.TypeOf(struct {
+				A int8
+				B [3]int8
+				C int32
+			}{}),
+		)
+	})
+}
+
+type keeper struct{}
+
+func (keeper) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	if t.Field(fieldIndex).Name == "Omit" {
+		return `json:"-"`
+	}
+	return KeepTag
+}
+
+type keptStruct struct {
+	Omit  int `json:"omit"`
+	Xport int `json:"xport,omitempty"`
+	Plain string
+}
+
+func TestKeepTag(test *testing.T) {
+	p := &keptStruct{}
+	source := reflect.TypeOf(p).Elem()
+	generated := reflect.TypeOf(Convert(p, keeper{})).Elem()
+	for i := 0; i < source.NumField(); i++ {
+		expected := source.Field(i).Tag
+		if source.Field(i).Name == "Omit" {
+			expected = `json:"-"`
+		}
+		if tag := generated.Field(i).Tag; tag != expected {
+			test.Errorf("Expect `%s` for the field %s but got `%s`", expected, source.Field(i).Name, tag)
+		}
+	}
+	if t := reflect.TypeOf(Convert(new(AnonymousVoidStruct), keeper{})).Elem(); t != reflect.TypeOf(AnonymousVoidStruct{}) {
+		test.Errorf("Expect the source type if all tags are kept but got %s", t)
+	}
+}
+
+func TestConvertAll(test *testing.T) {
+	ps := []interface{}{&FlatStruct{Xport: 1}, &Struct{Xport1: 2}, &FlatStruct{Xport: 3}}
+	res := ConvertAll(ps, maker{})
+	expected := []string{`{"Xport":1}`, `{"Xport1":2,"Xport2":{"Xport":0}}`, `{"Xport":3}`}
+	for i := range res {
+		(&MapTestCase{Result: expected[i]}).checkResult(res[i], test)
+	}
+	if reflect.TypeOf(res[0]) != reflect.TypeOf(res[2]) {
+		test.Error("Expect the same type for the same source type")
+	}
+
+	ps = append(ps, FlatStruct{})
+	func() {
+		defer func() {
+			err, _ := recover().(*Error)
+			if err == nil || !strings.HasPrefix(err.Msg, "element 3:") {
+				test.Errorf("Expect an error for the element 3 but got %v", err)
+			}
+		}()
+		ConvertAll(ps, maker{})
+	}()
+}
+
+func TestConvertInvalidArgument(test *testing.T) {
+	cases := []struct {
+		name string
+		p    interface{}
+		msg  string
+	}{
+		{"Nil", nil, "unable to convert nil, a pointer is expected"},
+		{"Value", FlatStruct{}, "unable to convert retag.FlatStruct, because it is a struct, not a pointer"},
+		{"PointerToInt", new(int), "unable to convert int, because it is not a structure, slice, array or map"},
+	}
+	for _, c := range cases {
+		test.Run(c.name, func(test *testing.T) {
+			if _, err := ConvertE(c.p, maker{}); err == nil || err.Error() != c.msg {
+				test.Errorf("Expect the error %q but got %v", c.msg, err)
+			}
+		})
+	}
+}
+
+func TestConvertTypedNil(test *testing.T) {
+	result := Convert((*FlatStruct)(nil), maker{})
+	v := reflect.ValueOf(result)
+	if v.Kind() != reflect.Pointer || !v.IsNil() {
+		test.Fatalf("Expect a nil pointer but got %#v", result)
+	}
+	if expected := reflect.TypeOf(Convert(new(FlatStruct), maker{})); v.Type() != expected {
+		test.Errorf("Expect the type %s but got %s", expected, v.Type())
+	}
+}
+
+type NestedArraysStruct struct {
+	XGrid      [3][4]FlatStruct
+	XRows      [2][]FlatStruct
+	XTables    [][2]FlatStruct
+	XEmptyGrid [0][2]FlatStruct
+}
+
+func TestConvertNestedArrays(test *testing.T) {
+	p := &NestedArraysStruct{XRows: [2][]FlatStruct{{{Omit: 1, Xport: 2}}}, XTables: [][2]FlatStruct{{{Xport: 3}}}}
+	p.XGrid[2][3].Xport = 4
+	result := Convert(p, maker{})
+	source := reflect.TypeOf(p).Elem()
+	generated := reflect.TypeOf(result).Elem()
+	if source.Size() != generated.Size() {
+		test.Errorf("Expect size %d but got %d", source.Size(), generated.Size())
+	}
+	for i := 0; i < source.NumField(); i++ {
+		st, gt := source.Field(i).Type, generated.Field(i).Type
+		for st.Kind() == reflect.Array || st.Kind() == reflect.Slice {
+			if st.Kind() != gt.Kind() || st.Kind() == reflect.Array && st.Len() != gt.Len() {
+				test.Errorf("Expect %s but got %s for the field %s", st, gt, source.Field(i).Name)
+				break
+			}
+			st, gt = st.Elem(), gt.Elem()
+		}
+		if tag := gt.Field(0).Tag; tag != `json:"-"` {
+			test.Errorf("Expect the element tags of the field %s to be changed but got `%s`", source.Field(i).Name, tag)
+		}
+	}
+	v := reflect.ValueOf(result).Elem()
+	if x := v.Field(0).Index(2).Index(3).Field(1).Int(); x != 4 {
+		test.Errorf("Expect 4 but got %d", x)
+	}
+	if x := v.Field(2).Index(0).Index(0).Field(1).Int(); x != 3 {
+		test.Errorf("Expect 3 but got %d", x)
+	}
+}
+
+type secretBox struct {
+	id   int
+	name string
+}
+
+type secretBoxMirror struct {
+	ID   int
+	Name string
+}
+
+func TestRegisterTypeMapper(test *testing.T) {
+	RegisterTypeMapper(reflect.TypeOf(secretBox{}), reflect.TypeOf(secretBoxMirror{}))
+	defer Reset()
+	p := &struct{ Box secretBox }{secretBox{1, "box"}}
+	result := Convert(p, Snaker("json"))
+	(&MapTestCase{Result: `{"box":{"i_d":1,"name":"box"}}`}).checkResult(result, test)
+
+	test.Run("Size", func(test *testing.T) {
+		defer shouldPanic(test)
+		RegisterTypeMapper(reflect.TypeOf(secretBox{}), reflect.TypeOf(FlatStruct{}))
+	})
+}
+
+type sliceMaker []string
+
+func (sliceMaker) MakeTag(t reflect.Type, fieldIndex int) reflect.StructTag {
+	return ""
+}
+
+func TestNonComparableMaker(test *testing.T) {
+	_, err := ConvertE(new(FlatStruct), sliceMaker{"json"})
+	expected := "retag: TagMaker type retag.sliceMaker must be comparable to be used as a cache key"
+	if err == nil || err.Error() != expected {
+		test.Errorf("Expect the error %q but got %v", expected, err)
+	}
+	if _, err := ConvertE(new(FlatStruct), nil); err == nil {
+		test.Error("Expect an error for nil maker")
+	}
+}
+
+type MapKeyStruct struct {
+	Omit  string
+	Xport int
+	Xname string
+}
+
+func TestConvertStructMapKey(test *testing.T) {
+	p := &map[MapKeyStruct]int{{"a", 1, "x"}: 1, {"b", 2, "y"}: 2}
+	v := reflect.ValueOf(Convert(p, maker{})).Elem()
+	key := v.Type().Key()
+	if tag := key.Field(0).Tag; tag != `json:"-"` {
+		test.Errorf("Expect the key type to be retagged but got `%s`", tag)
+	}
+	if v.Len() != 2 {
+		test.Errorf("Expect 2 entries but got %d", v.Len())
+	}
+	for k, x := range *p {
+		converted := reflect.NewAt(key, unsafe.Pointer(&k)).Elem()
+		if got := v.MapIndex(converted); !got.IsValid() || got.Int() != int64(x) {
+			test.Errorf("Expect %d for the key %v but got %v", x, k, got)
+		}
+	}
+	v.SetMapIndex(reflect.ValueOf(Convert(&MapKeyStruct{"c", 3, "z"}, maker{})).Elem(), reflect.ValueOf(3))
+	if (*p)[MapKeyStruct{"c", 3, "z"}] != 3 {
+		test.Error("Expect the entry added through the generated type to be found by the source key")
+	}
+}
+
+// IntMapKey is hashed by the compiler as a whole, a generated structure is hashed field by field.
+type IntMapKey struct {
+	Omit, Xport int
+}
+
+// PaddedIntMapKey is hashed field by field by the compiler because of the padding.
+type PaddedIntMapKey struct {
+	Omit  int8
+	Xport int32
+}
+
+func TestConvertIntMapKey(test *testing.T) {
+	p := &map[PaddedIntMapKey]int{{1, 2}: 1, {3, 4}: 2}
+	v := reflect.ValueOf(Convert(p, maker{})).Elem()
+	key := v.Type().Key()
+	for k, x := range *p {
+		converted := reflect.NewAt(key, unsafe.Pointer(&k)).Elem()
+		if got := v.MapIndex(converted); !got.IsValid() || got.Int() != int64(x) {
+			test.Errorf("Expect %d for the key %v but got %v", x, k, got)
+		}
+	}
+
+	_, err := ConvertE(&map[IntMapKey]int{{1, 2}: 1}, maker{})
+	if e, ok := err.(*Error); !ok || !strings.Contains(e.Msg, "hashed differently") {
+		test.Errorf("Expect an error about hashing of the key but got %v", err)
+	}
+}
+
+type TrailingZeroArrayStruct struct {
+	Omit int64
+	Xend [0]byte
+}
+
+func TestUnpaddedZeroSizeField(test *testing.T) {
+	for _, p := range []interface{}{new(AnonymousVoidStruct), new(TrailingZeroArrayStruct)} {
+		result := Convert(p, Snaker("json"))
+		if a, b := reflect.TypeOf(p).Elem().Size(), reflect.TypeOf(result).Elem().Size(); a != b {
+			test.Errorf("Expect size %d but got %d", a, b)
+		}
+	}
+
+	defer func() {
+		err, _ := recover().(*Error)
+		if err == nil || !strings.Contains(err.Msg, "final field Xend has zero size") {
+			test.Errorf("Expect the error about the final field but got %v", err)
+		}
+	}()
+	// the layout reflect.StructOf of go1.7 makes
+	unpadded := reflect.TypeOf(struct{ Omit int64 }{})
+	compareStructTypes(reflect.TypeOf(TrailingZeroArrayStruct{}), unpadded)
+}
+
+func TestConvertWithMapping(test *testing.T) {
+	cases := []struct {
+		p       interface{}
+		maker   TagMaker
+		mapping []int
+	}{
+		{new(ComplexStruct), maker{}, []int{0, 1, 2, 3, 4, 5}},
+		{new(BlankFieldStruct), maker{}, []int{0, 1, 2, 3}},
+		{new(privateStruct), NewCompositeTagMaker(), []int{0, 1, 2}},
+		{new([]FlatStruct), maker{}, nil},
+	}
+	for _, c := range cases {
+		_, mapping := ConvertWithMapping(c.p, c.maker)
+		if !reflect.DeepEqual(mapping, c.mapping) {
+			test.Errorf("Expect mapping %v for %T but got %v", c.mapping, c.p, mapping)
+		}
+	}
+}
+
+func TestConvertValueCopy(test *testing.T) {
+	source := FlatStruct{Omit: 1, Xport: 2}
+	res := ConvertValueCopy(source, maker{})
+	(&MapTestCase{Result: `{"Xport":2}`}).checkResult(res, test)
+	reflect.ValueOf(res).Elem().Field(1).SetInt(3)
+	if source.Xport != 2 {
+		test.Error("The source should not be modified")
+	}
+	if reflect.TypeOf(res) != reflect.TypeOf(Convert(&source, maker{})) {
+		test.Errorf("Unexpected type %s", reflect.TypeOf(res))
+	}
+	test.Run("Pointer", func(test *testing.T) {
+		defer shouldPanic(test)
+		ConvertValueCopy(&source, maker{})
+	})
+}
+
+type SiblingsStruct struct {
+	XFirst  FlatStruct
+	XSecond FlatStruct
+	XPtr    *FlatStruct
+}
+
+func TestConvertSiblings(test *testing.T) {
+	generated := reflect.TypeOf(ConvertWith(new(SiblingsStruct), maker{}, WithoutCache())).Elem()
+	for i := 0; i < 2; i++ {
+		if t := generated.Field(i).Type; t == reflect.TypeOf(FlatStruct{}) || t.Field(0).Tag != `json:"-"` {
+			test.Errorf("Expect the field %s to be rebuilt but got %s", generated.Field(i).Name, t)
+		}
+	}
+	if t := generated.Field(2).Type.Elem(); t != generated.Field(0).Type {
+		test.Errorf("Expect the same generated type for the pointer but got %s", t)
+	}
+}
+
+// boundary doesn't convert types of fields named Raw.
+type boundary struct{ maker }
+
+func (boundary) ShouldTreatAsOpaque(t reflect.Type, fieldIndex int) bool {
+	return t.Field(fieldIndex).Name == "Raw"
+}
+
+func TestFieldOpaqueDecider(test *testing.T) {
+	p := &struct {
+		Xport FlatStruct
+		Raw   FlatStruct
+	}{FlatStruct{1, 2}, FlatStruct{3, 4}}
+	res := Convert(p, boundary{})
+	generated := reflect.TypeOf(res).Elem()
+	if generated.Field(1).Type != reflect.TypeOf(FlatStruct{}) || generated.Field(1).Tag != `json:"-"` {
+		t := generated.Field(1)
+		test.Errorf("Expect the source type and a new tag for Raw but got %s `%s`", t.Type, t.Tag)
+	}
+	(&MapTestCase{Result: `{"Xport":{"Xport":2}}`}).checkResult(res, test)
+}
+
+func TestConvertType(test *testing.T) {
+	expected := reflect.TypeOf(Convert(new(Struct), maker{}))
+	if t := ConvertType(reflect.TypeOf(&Struct{}), maker{}); t != expected {
+		test.Errorf("Expect %s but got %s", expected, t)
+	}
+	if t := ConvertType(reflect.TypeOf(Struct{}), maker{}); t != expected.Elem() {
+		test.Errorf("Expect %s but got %s", expected.Elem(), t)
+	}
+	if t := ConvertType(reflect.TypeOf([]Struct{}), maker{}); t != reflect.SliceOf(expected.Elem()) {
+		test.Errorf("Expect slice of generated type but got %s", t)
+	}
+	test.Run("Unsupported", func(test *testing.T) {
+		defer shouldPanic(test)
+		ConvertType(reflect.TypeOf(0), maker{})
+	})
+	test.Run("Nil", func(test *testing.T) {
+		defer func() {
+			if err, ok := recover().(*Error); !ok || !strings.Contains(err.Msg, "unable to convert nil") {
+				test.Errorf("Expect *Error for nil but got %v", err)
+			}
+		}()
+		ConvertType(nil, maker{})
+	})
+}
+
 func shouldPanic(test *testing.T) {
 	if p := recover(); p == nil {
 		test.Fatal("It should panic")
@@ -175,13 +1061,24 @@ func BenchmarkConvert(b *testing.B) {
 	b.Run("Cold", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
 			b.StopTimer()
-			cache.m = make(map[cacheKey]result)
+			ClearCache()
 			b.StartTimer()
 			Convert(p, maker{})
 		}
 	})
 }
 
+func TestConvertCachedAllocs(test *testing.T) {
+	p := new(ComplexStruct)
+	Convert(p, maker{})
+	if n := testing.AllocsPerRun(100, func() { Convert(p, maker{}) }); n != 0 {
+		test.Errorf("Expect no allocations for a cached type, got %v", n)
+	}
+	if n := testing.AllocsPerRun(100, func() { ConvertWith(p, maker{}, WithAny()) }); n > 1 {
+		test.Errorf("Expect only the options to be allocated for a cached type, got %v", n)
+	}
+}
+
 type VoidFirst struct {
 	V struct{}
 	A int32
@@ -359,3 +1256,313 @@ type Membership struct {
 func TestCircularRef(t *testing.T) {
 	Convert(&Group{}, Snaker("gorm"))
 }
+
+type Node struct {
+	Name string
+	Next *Node
+}
+
+type Tree map[string][]Tree
+
+func TestConvertCyclic(test *testing.T) {
+	list := &Node{Name: "a", Next: &Node{Name: "b"}}
+	result := Convert(list, Snaker("json"))
+	// the back-edge keeps the source type, see Convert
+	(&MapTestCase{Result: `{"name":"a","next":{"Name":"b","Next":null}}`}).checkResult(result, test)
+	next := reflect.TypeOf(result).Elem().Field(1)
+	if next.Type != reflect.TypeOf(list) {
+		test.Errorf("Expect the back-edge of type %s but got %s", reflect.TypeOf(list), next.Type)
+	}
+}
+
+type backEdgeNode struct {
+	Omit  int
+	Xnext *backEdgeNode
+}
+
+func TestConvertBackEdgeNotCached(test *testing.T) {
+	// the pointer to the node is a back-edge while converting the node,
+	// it must not be cached as an unchanged type for other conversions
+	Convert(&backEdgeNode{}, maker{})
+	result := Convert(&struct{ Xnode *backEdgeNode }{Xnode: &backEdgeNode{}}, maker{})
+	(&MapTestCase{Result: `{"Xnode":{"Xnext":null}}`}).checkResult(result, test)
+}
+
+type treeNode struct {
+	Omit  int
+	Xname string
+	Xkids []treeNode
+}
+
+// keyedTree refers to itself without a structure, the key type has its own analogue.
+type keyedTree map[MapKeyStruct]keyedTree
+
+func TestConvertCyclicContainers(test *testing.T) {
+	test.Run("Slice", func(test *testing.T) {
+		tree := &treeNode{Xname: "a", Xkids: []treeNode{{Xname: "b"}}}
+		(&MapTestCase{Result: `{"Xname":"a","Xkids":[{"Omit":0,"Xname":"b","Xkids":null}]}`}).checkResult(Convert(tree, maker{}), test)
+	})
+	test.Run("NamedMap", func(test *testing.T) {
+		if got := reflect.TypeOf(Convert(&Tree{}, maker{})); got != reflect.TypeOf(&Tree{}) {
+			test.Errorf("Expect the type %s unchanged but got %s", reflect.TypeOf(&Tree{}), got)
+		}
+		generated := reflect.TypeOf(Convert(&keyedTree{}, maker{})).Elem()
+		if generated.Key() == reflect.TypeOf(MapKeyStruct{}) || generated.Elem() != reflect.TypeOf(keyedTree{}) {
+			test.Errorf("Expect the generated key and the back-edge of the source type but got %s", generated)
+		}
+	})
+}
+
+func TestIsCyclic(test *testing.T) {
+	cases := []struct {
+		t      reflect.Type
+		cyclic bool
+	}{
+		{reflect.TypeOf(Node{}), true},
+		{reflect.TypeOf(Group{}), true},
+		{reflect.TypeOf(Membership{}), true},
+		{reflect.TypeOf(Tree{}), true},
+		{reflect.TypeOf(&Node{}), true},
+		{reflect.TypeOf(ComplexStruct{}), false},
+		{reflect.TypeOf(FlatStruct{}), false},
+		{reflect.TypeOf(0), false},
+	}
+	for _, c := range cases {
+		if got := IsCyclic(c.t); got != c.cyclic {
+			test.Errorf("Expect IsCyclic(%s) = %v but got %v", c.t, c.cyclic, got)
+		}
+	}
+}
+
+// dagLevel types form a wide acyclic graph: every level refers to the previous one 4 times,
+// so a walk of every path from the top takes 4^14 steps.
+type dagLevel0 struct{ X int }
+type dagLevel1 struct{ A, B, C, D dagLevel0 }
+type dagLevel2 struct {
+	A, B dagLevel1
+	C    *dagLevel1
+	D    []dagLevel1
+}
+type dagLevel3 struct{ A, B, C, D dagLevel2 }
+type dagLevel4 struct {
+	A, B dagLevel3
+	C    *dagLevel3
+	D    []dagLevel3
+}
+type dagLevel5 struct{ A, B, C, D dagLevel4 }
+type dagLevel6 struct {
+	A, B dagLevel5
+	C    *dagLevel5
+	D    []dagLevel5
+}
+type dagLevel7 struct{ A, B, C, D dagLevel6 }
+type dagLevel8 struct {
+	A, B dagLevel7
+	C    *dagLevel7
+	D    []dagLevel7
+}
+type dagLevel9 struct{ A, B, C, D dagLevel8 }
+type dagLevel10 struct {
+	A, B dagLevel9
+	C    *dagLevel9
+	D    []dagLevel9
+}
+type dagLevel11 struct{ A, B, C, D dagLevel10 }
+type dagLevel12 struct {
+	A, B dagLevel11
+	C    *dagLevel11
+	D    []dagLevel11
+}
+
+type dagLevel13 struct{ A, B, C, D dagLevel12 }
+type dagLevel14 struct{ A, B, C, D dagLevel13 }
+
+func TestIsCyclicSharedTypes(test *testing.T) {
+	if IsCyclic(reflect.TypeOf(dagLevel14{})) {
+		test.Error("Expect an acyclic type")
+	}
+}
+
+type genericResponse[T any] struct {
+	Xdata T
+	Xnext *genericResponse[T]
+	Omit  int
+}
+
+type genericUser struct {
+	Xname string
+	Omit  int
+}
+
+type genericOrder struct {
+	Xtotal int
+	Omit   string
+}
+
+func TestConvertGenericInstantiations(test *testing.T) {
+	// the instantiations share the name of the generic type,
+	// but they are different types both in the seen guard and in the cache;
+	// the back-edge Xnext keeps the source type of its own instantiation
+	user := &genericResponse[genericUser]{Xdata: genericUser{Xname: "a"}, Xnext: &genericResponse[genericUser]{}}
+	order := &genericResponse[genericOrder]{Xdata: genericOrder{Xtotal: 1}, Xnext: &genericResponse[genericOrder]{}}
+	for i := 0; i < 2; i++ { // the second pass uses the cache
+		(&MapTestCase{Result: `{"Xdata":{"Xname":"a"},"Xnext":{"Xdata":{"Xname":"","Omit":0},"Xnext":null,"Omit":0}}`}).checkResult(Convert(user, maker{}), test)
+		(&MapTestCase{Result: `{"Xdata":{"Xtotal":1},"Xnext":{"Xdata":{"Xtotal":0,"Omit":""},"Xnext":null,"Omit":0}}`}).checkResult(Convert(order, maker{}), test)
+	}
+}
+
+type namedSlice []FlatStruct
+
+type namedMap map[string]FlatStruct
+
+type namedInts []int
+
+func TestConvertNamedContainers(test *testing.T) {
+	p := &struct {
+		Xslice namedSlice
+		Xmap   namedMap
+		Xints  namedInts
+	}{
+		Xslice: namedSlice{{Omit: 1, Xport: 2}},
+		Xmap:   namedMap{"a": {Omit: 3, Xport: 4}},
+		Xints:  namedInts{5},
+	}
+	result := Convert(p, maker{})
+	(&MapTestCase{Result: `{"Xslice":[{"Xport":2}],"Xmap":{"a":{"Xport":4}},"Xints":[5]}`}).checkResult(result, test)
+	generated := reflect.TypeOf(result).Elem()
+	// reflect can't create named types, so the replacements are unnamed
+	for _, name := range []string{"Xslice", "Xmap"} {
+		if f, _ := generated.FieldByName(name); f.Type.Name() != "" {
+			test.Errorf("Expect an unnamed type of %s but got %s", name, f.Type)
+		}
+	}
+	// a named type without replaced elements is kept
+	if f, _ := generated.FieldByName("Xints"); f.Type != reflect.TypeOf(namedInts{}) {
+		test.Errorf("Expect the type %s of Xints but got %s", reflect.TypeOf(namedInts{}), f.Type)
+	}
+}
+
+func TestConvertChecked(test *testing.T) {
+	p := &FlatStruct{Omit: 1, Xport: 2}
+	res, changed := ConvertChecked(p, maker{})
+	if !changed {
+		test.Error("Expect the type to be changed")
+	}
+	(&MapTestCase{Result: `{"Xport":2}`}).checkResult(res, test)
+
+	unchanged := &struct{ Xport int }{Xport: 3}
+	res, changed = ConvertChecked(unchanged, maker{})
+	if changed || res != interface{}(unchanged) {
+		test.Errorf("Expect the source to be returned unchanged but got %T (changed %v)", res, changed)
+	}
+}
+
+func TestConvertScalarKinds(test *testing.T) {
+	type scalars struct {
+		Xbool      bool
+		Xcomplex   complex128
+		Xuintptr   uintptr
+		Xfloat32   float32
+		Xcomplex64 complex64
+		Xint8      int8
+	}
+	p := &scalars{true, 1 + 2i, 3, 4.5, 6 - 7i, -8}
+	result := Convert(p, Snaker("json"))
+	v := reflect.ValueOf(result).Elem()
+	if !v.Field(0).Bool() || v.Field(1).Complex() != 1+2i || v.Field(2).Uint() != 3 ||
+		v.Field(3).Float() != 4.5 || v.Field(4).Complex() != 6-7i || v.Field(5).Int() != -8 {
+		test.Errorf("Expect the values of the source but got %+v", v.Interface())
+	}
+	source := reflect.TypeOf(scalars{})
+	generated := reflect.TypeOf(result).Elem()
+	if generated == source || generated.Size() != source.Size() {
+		test.Fatalf("Expect a distinct type of size %d but got %s of size %d", source.Size(), generated, generated.Size())
+	}
+	for i := 0; i < source.NumField(); i++ {
+		a, b := source.Field(i), generated.Field(i)
+		if a.Type != b.Type || a.Offset != b.Offset {
+			test.Errorf("Expect the field %s of type %s at %d but got %s at %d", a.Name, a.Type, a.Offset, b.Type, b.Offset)
+		}
+		if expected := reflect.StructTag(`json:"` + CamelToSnake(a.Name) + `"`); b.Tag != expected {
+			test.Errorf("Expect the tag `%s` of the field %s but got `%s`", expected, a.Name, b.Tag)
+		}
+	}
+}
+
+func TestConvertContainersOfPointers(test *testing.T) {
+	inner := &FlatStruct{Omit: 1, Xport: 2}
+	p := &struct {
+		Xarray [2]*FlatStruct
+		Xslice []*FlatStruct
+		Xmap   map[string]*FlatStruct
+		Xdeep  [1][]*[1]*FlatStruct
+	}{
+		Xarray: [2]*FlatStruct{inner},
+		Xslice: []*FlatStruct{inner},
+		Xmap:   map[string]*FlatStruct{"a": inner},
+		Xdeep:  [1][]*[1]*FlatStruct{{{inner}}},
+	}
+	result := Convert(p, maker{})
+	(&MapTestCase{Result: `{"Xarray":[{"Xport":2},null],"Xslice":[{"Xport":2}],"Xmap":{"a":{"Xport":2}},"Xdeep":[[[{"Xport":2}]]]}`}).checkResult(result, test)
+	generated := reflect.TypeOf(Convert(inner, maker{}))
+	v := reflect.ValueOf(result).Elem()
+	for _, elem := range []reflect.Type{
+		v.Field(0).Type().Elem(),
+		v.Field(1).Type().Elem(),
+		v.Field(2).Type().Elem(),
+		v.Field(3).Type().Elem().Elem().Elem().Elem(),
+	} {
+		if elem != generated {
+			test.Errorf("Expect the element type %s but got %s", generated, elem)
+		}
+	}
+}
+
+type pathRoot struct {
+	Xorders []pathOrder
+}
+
+type pathOrder struct {
+	Xid      int
+	Xhandler func()
+}
+
+func TestErrorPath(test *testing.T) {
+	cases := []struct {
+		name string
+		p    interface{}
+		path string
+	}{
+		{"Struct", new(pathRoot), "pathRoot.Xorders[].Xhandler"},
+		{"Slice", new([]pathOrder), "[].Xhandler"},
+		{"Unnamed", new(struct{ Xorder *pathOrder }), "Xorder.Xhandler"},
+		{"Root", new(pathOrder), "pathOrder.Xhandler"},
+	}
+	for _, c := range cases {
+		test.Run(c.name, func(test *testing.T) {
+			_, err := ConvertE(c.p, maker{})
+			e, ok := err.(*Error)
+			if !ok || e.Path != c.path {
+				test.Fatalf("Expect *Error at %s but got %v", c.path, err)
+			}
+			if expected := "tags.Map: Unsupported type: func (at " + c.path + ")"; e.Error() != expected {
+				test.Errorf("Expect the error %q but got %q", expected, e.Error())
+			}
+		})
+	}
+
+	test.Run("MapValue", func(test *testing.T) {
+		_, err := ConvertE(&struct{ Xindex map[string]*pathOrder }{}, maker{})
+		if e, ok := err.(*Error); !ok || e.Path != "Xindex[].Xhandler" {
+			test.Errorf("Expect *Error at Xindex[].Xhandler but got %v", err)
+		}
+	})
+	test.Run("ConvertAll", func(test *testing.T) {
+		defer func() {
+			if e, ok := recover().(*Error); !ok || e.Path != "pathOrder.Xhandler" || !strings.HasPrefix(e.Msg, "element 0: ") {
+				test.Errorf("Expect *Error of the element 0 at pathOrder.Xhandler but got %v", e)
+			}
+		}()
+		ConvertAll([]interface{}{new(pathOrder)}, maker{})
+	})
+}